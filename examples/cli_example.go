@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/ironystock/civic-auth-go/pkg/civicauth"
 )
@@ -12,7 +15,7 @@ func main() {
 	// Create configuration
 	config := civicauth.DefaultConfig()
 	config.ClientID = getEnv("CIVIC_CLIENT_ID", "your-client-id")
-	config.ClientSecret = getEnv("CIVIC_CLIENT_SECRET", "your-client-secret")
+	config.PublicClient = true // CLI apps cannot keep a secret, so they rely on PKCE
 	config.RedirectURL = getEnv("CIVIC_REDIRECT_URL", "http://localhost:8080/callback")
 	config.Issuer = getEnv("CIVIC_ISSUER", "https://auth.civicauth.com")
 
@@ -22,35 +25,48 @@ func main() {
 		log.Fatalf("Failed to create client: %v", err)
 	}
 
+	// Sign in through the system browser with a loopback redirect, or with the
+	// device authorization grant on headless machines
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "login":
+			browserLogin(client)
+			return
+		case "device":
+			deviceLogin(client)
+			return
+		}
+	}
+
 	// Example 1: Generate authorization URL with PKCE
 	fmt.Println("=== Authorization Code Flow with PKCE ===")
-	authURL, state, codeVerifier, err := client.CreateAuthorizationFlow()
+	authURL, state, nonce, codeVerifier, err := client.CreateAuthorizationFlow()
 	if err != nil {
 		log.Fatalf("Failed to create authorization flow: %v", err)
 	}
 
 	fmt.Printf("1. Visit this URL to authorize the application:\n%s\n\n", authURL)
 	fmt.Printf("2. State parameter: %s\n", state)
-	fmt.Printf("3. Code verifier (keep secret): %s\n\n", codeVerifier)
-
-	// In a real CLI app, you would:
-	// 1. Open the browser with the auth URL
-	// 2. Start a temporary HTTP server to receive the callback
-	// 3. Extract the authorization code from the callback
-	// 4. Exchange the code for tokens
-
-	// Example 2: Manual authorization URL generation
-	fmt.Println("=== Manual Authorization URL Generation ===")
-	opts := &civicauth.AuthCodeURLOptions{
-		State:  "my-custom-state",
-		Prompt: "consent", // Force consent screen
+	fmt.Printf("3. Nonce (verify against the ID token): %s\n", nonce)
+	fmt.Printf("4. Code verifier (keep secret): %s\n\n", codeVerifier)
+
+	// To complete the flow from a CLI, run "cli_example login": AuthorizeWithLoopback
+	// opens the browser, receives the callback on 127.0.0.1 and exchanges the code
+
+	// Example 2: Authorization URL with extra parameters. Public clients must
+	// always send a code challenge, so GetAuthCodeURL without one fails.
+	fmt.Println("=== Authorization URL with Options ===")
+	if _, err := client.GetAuthCodeURL(&civicauth.AuthCodeURLOptions{State: "my-custom-state"}); errors.Is(err, civicauth.ErrPKCERequired) {
+		fmt.Println("GetAuthCodeURL without a code challenge is rejected for public clients")
 	}
 
-	manualAuthURL, err := client.GetAuthCodeURL(opts)
+	consentURL, _, _, _, err := client.CreateAuthorizationFlowWithOptions(&civicauth.AuthCodeURLOptions{
+		Prompt: "consent", // Force consent screen
+	})
 	if err != nil {
 		log.Fatalf("Failed to generate auth URL: %v", err)
 	}
-	fmt.Printf("Manual auth URL: %s\n\n", manualAuthURL)
+	fmt.Printf("Consent auth URL: %s\n\n", consentURL)
 
 	// Example 3: Token validation (if you have an ID token)
 	fmt.Println("=== Token Management Example ===")
@@ -92,6 +108,54 @@ func main() {
 	fmt.Printf("Scopes: %v\n", config.Scopes)
 }
 
+// browserLogin signs the user in through the system browser, receiving the
+// callback on a temporary loopback listener
+func browserLogin(client *civicauth.Client) {
+	result, err := client.AuthorizeWithLoopback(context.Background(), &civicauth.LoopbackOptions{
+		TokenManager: civicauth.NewTokenManager(client),
+		OpenBrowser: func(authURL string) error {
+			fmt.Printf("Opening the browser to sign in. If it does not open, visit:\n%s\n\n", authURL)
+			return civicauth.OpenBrowser(authURL)
+		},
+	})
+	if err != nil {
+		log.Fatalf("Sign-in failed: %v", err)
+	}
+
+	fmt.Printf("Signed in as %s (token expires in %d seconds)\n", result.Claims.Subject, result.Tokens.ExpiresIn)
+}
+
+// deviceLogin signs the user in with the Device Authorization Grant: the user
+// approves the request on another device while the CLI polls for tokens
+func deviceLogin(client *civicauth.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	defer cancel()
+
+	auth, err := client.StartDeviceAuthorization(ctx, nil)
+	if err != nil {
+		log.Fatalf("Failed to start device authorization: %v", err)
+	}
+
+	fmt.Println("=== Device Authorization ===")
+	if auth.VerificationURIComplete != "" {
+		fmt.Printf("Visit %s to sign in\n", auth.VerificationURIComplete)
+	}
+	fmt.Printf("Or go to %s and enter the code: %s\n\n", auth.VerificationURI, auth.UserCode)
+	fmt.Println("Waiting for approval...")
+
+	tokens, err := client.PollDeviceToken(ctx, auth)
+	switch {
+	case errors.Is(err, civicauth.ErrAccessDenied):
+		log.Fatal("Sign-in was denied")
+	case errors.Is(err, civicauth.ErrExpiredToken):
+		log.Fatal("The code expired, please try again")
+	case err != nil:
+		log.Fatalf("Device authorization failed: %v", err)
+	}
+
+	fmt.Printf("Signed in: token_type=%s, expires_in=%d\n", tokens.TokenType, tokens.ExpiresIn)
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
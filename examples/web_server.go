@@ -1,23 +1,17 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/ironystock/civic-auth-go/pkg/civicauth"
 )
 
-// Session storage (in production, use a proper session store)
-var sessions = make(map[string]*SessionData)
-
-type SessionData struct {
-	State        string
-	CodeVerifier string
-	UserID       string
-}
-
 func main() {
 	// Get configuration from environment variables
 	config := civicauth.DefaultConfig()
@@ -32,17 +26,31 @@ func main() {
 		log.Fatalf("Failed to create Civic Auth client: %v", err)
 	}
 
-	// Create token storage and managers
-	storage := civicauth.NewInMemoryTokenStorage()
-	tokenManager := civicauth.NewTokenManager(client)
-	refreshManager := civicauth.NewTokenRefreshManager(client, storage)
+	// Sessions expire after 30 minutes of inactivity or 12 hours after login. Session
+	// cookies are only sent over HTTPS unless the app runs on plain HTTP locally.
+	secure := strings.HasPrefix(config.RedirectURL, "https://")
+	sessions := civicauth.NewMemorySessionStore(&civicauth.SessionOptions{
+		IdleTimeout:     30 * time.Minute,
+		AbsoluteTimeout: 12 * time.Hour,
+		Secure:          &secure,
+	})
+
+	// The auth handler keeps the login flow state, validates the callback and starts
+	// a new session with the user's tokens on every login
+	authHandler := civicauth.NewAuthHandler(client, sessions, &civicauth.AuthHandlerOptions{
+		PostLogoutRedirectURL: "http://localhost:8080",
+		AfterLogin: func(w http.ResponseWriter, r *http.Request, login *civicauth.LoginResult) error {
+			log.Printf("User %s logged in", login.Session.Subject)
+			return nil
+		},
+	})
 
 	// Set up HTTP handlers
 	http.HandleFunc("/", homeHandler)
-	http.HandleFunc("/login", loginHandler(client))
-	http.HandleFunc("/callback", callbackHandler(client, tokenManager, storage))
-	http.HandleFunc("/profile", profileHandler(refreshManager))
-	http.HandleFunc("/logout", logoutHandler(client))
+	http.HandleFunc("/login", authHandler.Login)
+	http.HandleFunc("/callback", authHandler.Callback)
+	http.HandleFunc("/logout", authHandler.Logout)
+	http.HandleFunc("/profile", profileHandler(client, authHandler))
 
 	fmt.Println("Starting server on :8080")
 	fmt.Println("Visit http://localhost:8080 to test the integration")
@@ -74,130 +82,22 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(html))
 }
 
-func loginHandler(client *civicauth.Client) http.HandlerFunc {
+func profileHandler(client *civicauth.Client, authHandler *civicauth.AuthHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Generate authorization flow parameters
-		authURL, state, codeVerifier, err := client.CreateAuthorizationFlow()
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to create authorization flow: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		// Store session data (in production, use proper session management)
-		sessionID := generateSessionID()
-		sessions[sessionID] = &SessionData{
-			State:        state,
-			CodeVerifier: codeVerifier,
-		}
-
-		// Set session cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session_id",
-			Value:    sessionID,
-			HttpOnly: true,
-			Path:     "/",
-		})
-
-		// Redirect to authorization URL
-		http.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
-	}
-}
-
-func callbackHandler(client *civicauth.Client, tokenManager *civicauth.TokenManager, storage civicauth.TokenStorage) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Get session data
-		cookie, err := r.Cookie("session_id")
-		if err != nil {
-			http.Error(w, "Session not found", http.StatusBadRequest)
+		// Get the session, refreshing its tokens if needed
+		session, err := authHandler.Session(w, r)
+		if errors.Is(err, civicauth.ErrSessionNotFound) {
+			// Send users without a session to login, returning here afterwards
+			http.Redirect(w, r, "/login?return_to=/profile", http.StatusTemporaryRedirect)
 			return
 		}
-
-		session, exists := sessions[cookie.Value]
-		if !exists {
-			http.Error(w, "Invalid session", http.StatusBadRequest)
-			return
-		}
-
-		// Validate state parameter
-		state := r.URL.Query().Get("state")
-		if state != session.State {
-			http.Error(w, "Invalid state parameter", http.StatusBadRequest)
-			return
-		}
-
-		// Get authorization code
-		code := r.URL.Query().Get("code")
-		if code == "" {
-			errorParam := r.URL.Query().Get("error")
-			errorDesc := r.URL.Query().Get("error_description")
-			http.Error(w, fmt.Sprintf("Authorization failed: %s - %s", errorParam, errorDesc), http.StatusBadRequest)
-			return
-		}
-
-		// Exchange code for tokens
-		tokens, err := client.ExchangeCodeForTokens(r.Context(), code, session.CodeVerifier)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to exchange code for tokens: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		// Validate ID token if present
-		var userID string
-		if tokens.IDToken != "" {
-			claims, err := tokenManager.ValidateIDToken(r.Context(), tokens.IDToken)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Failed to validate ID token: %v", err), http.StatusInternalServerError)
-				return
-			}
-			userID = claims.Subject
-		} else {
-			// If no ID token, get user info from userinfo endpoint
-			userInfo, err := client.GetUserInfo(r.Context(), tokens.AccessToken)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Failed to get user info: %v", err), http.StatusInternalServerError)
-				return
-			}
-			userID = userInfo.Sub
-		}
-
-		// Store tokens
-		if err := storage.Store(userID, tokens); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to store tokens: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		// Update session with user ID
-		session.UserID = userID
-
-		// Redirect to profile page
-		http.Redirect(w, r, "/profile", http.StatusTemporaryRedirect)
-	}
-}
-
-func profileHandler(refreshManager *civicauth.TokenRefreshManager) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Get session data
-		cookie, err := r.Cookie("session_id")
-		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
-			return
-		}
-
-		session, exists := sessions[cookie.Value]
-		if !exists || session.UserID == "" {
-			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
-			return
-		}
-
-		// Get valid tokens (will refresh if needed)
-		tokens, err := refreshManager.GetValidToken(r.Context(), session.UserID)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get valid tokens: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to get session: %v", err), http.StatusInternalServerError)
 			return
 		}
 
 		// Get user information
-		userInfo, err := refreshManager.Client.GetUserInfo(r.Context(), tokens.AccessToken)
+		userInfo, err := client.GetUserInfo(r.Context(), session.Tokens.AccessToken)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to get user info: %v", err), http.StatusInternalServerError)
 			return
@@ -246,40 +146,6 @@ func profileHandler(refreshManager *civicauth.TokenRefreshManager) http.HandlerF
 	}
 }
 
-func logoutHandler(client *civicauth.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Get session data
-		cookie, err := r.Cookie("session_id")
-		if err == nil {
-			if session, exists := sessions[cookie.Value]; exists && session.UserID != "" {
-				// Clear stored tokens
-				// In a real implementation, you'd get the ID token for logout
-				delete(sessions, cookie.Value)
-			}
-		}
-
-		// Clear session cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session_id",
-			Value:    "",
-			HttpOnly: true,
-			Path:     "/",
-			MaxAge:   -1,
-		})
-
-		// Generate logout URL (you would typically include the ID token hint)
-		logoutURL, err := client.GetLogoutURL("http://localhost:8080", "")
-		if err != nil {
-			// If logout URL generation fails, just redirect to home
-			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-			return
-		}
-
-		// Redirect to logout URL
-		http.Redirect(w, r, logoutURL, http.StatusTemporaryRedirect)
-	}
-}
-
 // Helper functions
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -287,8 +153,3 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
-
-func generateSessionID() string {
-	// In production, use a proper session ID generator
-	return fmt.Sprintf("session_%d", len(sessions))
-}
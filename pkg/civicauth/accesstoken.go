@@ -0,0 +1,69 @@
+package civicauth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// AccessTokenValidator validates JWT access tokens for a resource server, following
+// the JWT profile for OAuth 2.0 access tokens (RFC 9068). It shares the signing key
+// cache of its TokenManager.
+type AccessTokenValidator struct {
+	tm       *TokenManager
+	audience string
+}
+
+// NewAccessTokenValidator creates a validator accepting access tokens issued for
+// audience, the resource server's API identifier (not the client ID)
+func NewAccessTokenValidator(tm *TokenManager, audience string) *AccessTokenValidator {
+	return &AccessTokenValidator{
+		tm:       tm,
+		audience: audience,
+	}
+}
+
+// ValidateAccessToken verifies a JWT access token's signature, type (at+jwt), issuer,
+// audience and lifetime, and requires the sub, client_id, iat and jti claims. The
+// token's scope, roles, groups and entitlements are available on the returned Claims.
+func (v *AccessTokenValidator) ValidateAccessToken(ctx context.Context, accessToken string) (*Claims, error) {
+	token, claims, err := v.tm.verifyToken(ctx, accessToken, "access token")
+	if err != nil {
+		return nil, err
+	}
+
+	// The typ header keeps ID tokens and other JWTs from being accepted as access tokens
+	typ, _ := token.Header["typ"].(string)
+	if !isAccessTokenType(typ) {
+		return nil, fmt.Errorf("invalid token type %q, expected at+jwt", typ)
+	}
+
+	// Validate issuer
+	if claims.Issuer != v.tm.Client.config.Issuer {
+		return nil, fmt.Errorf("invalid issuer: expected %s, got %s", v.tm.Client.config.Issuer, claims.Issuer)
+	}
+
+	// Validate audience
+	if !claims.Audience.Contains(v.audience) {
+		return nil, fmt.Errorf("invalid audience: expected %s, got %v", v.audience, []string(claims.Audience))
+	}
+
+	// Validate required claims
+	switch {
+	case claims.Subject == "":
+		return nil, fmt.Errorf("token is missing sub")
+	case claims.ClientID == "":
+		return nil, fmt.Errorf("token is missing client_id")
+	case claims.IssuedAt == 0:
+		return nil, fmt.Errorf("token is missing iat")
+	case claims.JWTID == "":
+		return nil, fmt.Errorf("token is missing jti")
+	}
+
+	return claims, nil
+}
+
+// isAccessTokenType reports whether typ identifies a JWT access token (RFC 9068 section 2.1)
+func isAccessTokenType(typ string) bool {
+	return strings.EqualFold(typ, "at+jwt") || strings.EqualFold(typ, "application/at+jwt")
+}
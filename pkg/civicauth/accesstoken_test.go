@@ -0,0 +1,111 @@
+package civicauth
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// accessTokenClaims returns a valid set of JWT access token claims for the test API
+func (p *testProvider) accessTokenClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":       p.server.URL,
+		"sub":       "user123",
+		"aud":       "https://api.example.com",
+		"client_id": "test-client-id",
+		"jti":       "token-id",
+		"exp":       now.Add(time.Hour).Unix(),
+		"iat":       now.Unix(),
+		"scope":     "orders:read orders:write",
+		"roles":     []string{"admin"},
+		"groups":    []string{"engineering", "oncall"},
+	}
+}
+
+// signAccessToken signs the claims with the provider's key using the given typ header
+func (p *testProvider) signAccessToken(t *testing.T, typ string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = p.kid
+	token.Header["typ"] = typ
+
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestValidateAccessToken(t *testing.T) {
+	provider := newTestProvider(t)
+	client := provider.newClient(t, nil)
+	tm := NewTokenManager(client)
+	validator := NewAccessTokenValidator(tm, "https://api.example.com")
+	ctx := context.Background()
+
+	claims, err := validator.ValidateAccessToken(ctx, provider.signAccessToken(t, "at+jwt", provider.accessTokenClaims()))
+	if err != nil {
+		t.Fatalf("Failed to validate access token: %v", err)
+	}
+
+	if claims.ClientID != "test-client-id" || claims.JWTID != "token-id" {
+		t.Errorf("Expected client_id and jti claims, got %+v", claims)
+	}
+	if !claims.Scope.Contains("orders:write") || len(claims.Scope) != 2 {
+		t.Errorf("Expected scopes to be parsed, got %v", claims.Scope)
+	}
+	if len(claims.Roles) != 1 || len(claims.Groups) != 2 {
+		t.Errorf("Expected roles and groups, got %v and %v", claims.Roles, claims.Groups)
+	}
+	if claims.Extra["client_id"] != "test-client-id" {
+		t.Errorf("Expected all claims in Extra, got %v", claims.Extra)
+	}
+
+	if _, err := validator.ValidateAccessToken(ctx, provider.signAccessToken(t, "application/at+jwt", provider.accessTokenClaims())); err != nil {
+		t.Errorf("Expected application/at+jwt to be accepted, got: %v", err)
+	}
+
+	// The validator shares the token manager's key cache
+	if _, err := tm.keys.getKey(ctx, provider.kid); err != nil || atomic.LoadInt32(&provider.jwksRequests) != 1 {
+		t.Errorf("Expected a single JWKS request shared with the token manager, got %d", provider.jwksRequests)
+	}
+}
+
+func TestValidateAccessTokenRejections(t *testing.T) {
+	provider := newTestProvider(t)
+	validator := NewAccessTokenValidator(NewTokenManager(provider.newClient(t, nil)), "https://api.example.com")
+
+	tests := []struct {
+		name   string
+		typ    string
+		modify func(jwt.MapClaims)
+	}{
+		{name: "ID token type", typ: "JWT"},
+		{name: "missing type", typ: ""},
+		{name: "client ID audience", typ: "at+jwt", modify: func(c jwt.MapClaims) { c["aud"] = "test-client-id" }},
+		{name: "wrong issuer", typ: "at+jwt", modify: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{name: "expired", typ: "at+jwt", modify: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{name: "missing client_id", typ: "at+jwt", modify: func(c jwt.MapClaims) { delete(c, "client_id") }},
+		{name: "missing sub", typ: "at+jwt", modify: func(c jwt.MapClaims) { delete(c, "sub") }},
+		{name: "missing jti", typ: "at+jwt", modify: func(c jwt.MapClaims) { delete(c, "jti") }},
+		{name: "missing iat", typ: "at+jwt", modify: func(c jwt.MapClaims) { delete(c, "iat") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := provider.accessTokenClaims()
+			if tt.modify != nil {
+				tt.modify(claims)
+			}
+
+			if _, err := validator.ValidateAccessToken(context.Background(), provider.signAccessToken(t, tt.typ, claims)); err == nil {
+				t.Error("Expected error validating access token, got nil")
+			}
+		})
+	}
+}
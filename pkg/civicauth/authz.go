@@ -0,0 +1,243 @@
+package civicauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Requirement is an authorization rule checked against the claims of an authenticated
+// request. It returns nil when the claims satisfy the rule, and typically an
+// *InsufficientScopeError otherwise.
+type Requirement func(claims *Claims) error
+
+// InsufficientScopeError reports claims that do not satisfy a Requirement. It matches
+// ErrInsufficientScope with errors.Is.
+type InsufficientScopeError struct {
+	// Scope lists the scopes that would satisfy the requirement, if any
+	Scope []string
+
+	// Description explains the unmet requirement
+	Description string
+}
+
+// Error implements the error interface
+func (e *InsufficientScopeError) Error() string {
+	return "insufficient scope: " + e.Description
+}
+
+// Unwrap returns ErrInsufficientScope
+func (e *InsufficientScopeError) Unwrap() error {
+	return ErrInsufficientScope
+}
+
+// RequireScope requires every one of the given scopes
+func RequireScope(scopes ...string) Requirement {
+	return func(claims *Claims) error {
+		var missing []string
+		for _, scope := range scopes {
+			if !claims.Scope.Contains(scope) {
+				missing = append(missing, scope)
+			}
+		}
+		if len(missing) > 0 {
+			return &InsufficientScopeError{
+				Scope:       scopes,
+				Description: "missing scope " + strings.Join(missing, " "),
+			}
+		}
+		return nil
+	}
+}
+
+// RequireAnyScope requires at least one of the given scopes
+func RequireAnyScope(scopes ...string) Requirement {
+	return func(claims *Claims) error {
+		for _, scope := range scopes {
+			if claims.Scope.Contains(scope) {
+				return nil
+			}
+		}
+		return &InsufficientScopeError{
+			Scope:       scopes,
+			Description: "requires one of the scopes " + strings.Join(scopes, " "),
+		}
+	}
+}
+
+// RequireClaim requires the named claim to be present and, if values are given, to
+// equal one of them. Array claims such as roles and groups match if they contain one
+// of the values.
+func RequireClaim(name string, values ...string) Requirement {
+	return func(claims *Claims) error {
+		value, ok := claimValue(claims, name)
+		if !ok {
+			return &InsufficientScopeError{Description: "missing claim " + name}
+		}
+		if len(values) == 0 || claimMatches(value, values) {
+			return nil
+		}
+		return &InsufficientScopeError{Description: fmt.Sprintf("claim %s must be one of %s", name, strings.Join(values, ", "))}
+	}
+}
+
+// RequireEmailVerified requires an email address verified by the provider
+func RequireEmailVerified() Requirement {
+	return func(claims *Claims) error {
+		if claims.Email == "" || !claims.EmailVerified {
+			return &InsufficientScopeError{Description: "verified email required"}
+		}
+		return nil
+	}
+}
+
+// RequireFunc adapts a custom predicate into a Requirement, failing with description
+// when it returns false
+func RequireFunc(description string, fn func(claims *Claims) bool) Requirement {
+	return func(claims *Claims) error {
+		if !fn(claims) {
+			return &InsufficientScopeError{Description: description}
+		}
+		return nil
+	}
+}
+
+// AllOf requires every one of reqs. The scopes of all unmet requirements are reported.
+func AllOf(reqs ...Requirement) Requirement {
+	return func(claims *Claims) error {
+		var failures []error
+		for _, req := range reqs {
+			if err := req(claims); err != nil {
+				failures = append(failures, err)
+			}
+		}
+		return combineFailures(failures, "; ")
+	}
+}
+
+// AnyOf requires at least one of reqs
+func AnyOf(reqs ...Requirement) Requirement {
+	return func(claims *Claims) error {
+		var failures []error
+		for _, req := range reqs {
+			err := req(claims)
+			if err == nil {
+				return nil
+			}
+			failures = append(failures, err)
+		}
+		return combineFailures(failures, " or ")
+	}
+}
+
+// combineFailures merges the errors of several requirements into one, joining their
+// descriptions with sep and collecting their scopes
+func combineFailures(failures []error, sep string) error {
+	switch len(failures) {
+	case 0:
+		return nil
+	case 1:
+		return failures[0]
+	}
+
+	combined := &InsufficientScopeError{}
+	var descriptions []string
+	for _, err := range failures {
+		var scopeErr *InsufficientScopeError
+		if !errors.As(err, &scopeErr) {
+			// Errors from custom requirements are returned as they are
+			return err
+		}
+		for _, scope := range scopeErr.Scope {
+			if !ScopeList(combined.Scope).Contains(scope) {
+				combined.Scope = append(combined.Scope, scope)
+			}
+		}
+		descriptions = append(descriptions, scopeErr.Description)
+	}
+	combined.Description = strings.Join(descriptions, sep)
+	return combined
+}
+
+// claimValue looks up a claim by name, falling back to the fields of claims when it
+// was not built from a token
+func claimValue(claims *Claims, name string) (interface{}, bool) {
+	if claims.Extra != nil {
+		value, ok := claims.Extra[name]
+		return value, ok && value != nil
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, false
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, false
+	}
+	value, ok := fields[name]
+	return value, ok && value != nil
+}
+
+// claimMatches reports whether a claim value, or an element of an array claim, equals
+// one of values. Space-separated scope claims are matched per scope.
+func claimMatches(value interface{}, values []string) bool {
+	var candidates []string
+	switch v := value.(type) {
+	case []interface{}:
+		for _, elem := range v {
+			candidates = append(candidates, fmt.Sprint(elem))
+		}
+	case string:
+		candidates = []string{v}
+		if len(strings.Fields(v)) > 1 {
+			candidates = strings.Fields(v)
+		}
+	default:
+		candidates = []string{fmt.Sprint(v)}
+	}
+
+	for _, candidate := range candidates {
+		for _, want := range values {
+			if candidate == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Require returns middleware that checks reqs against the claims stored by Middleware,
+// which must run first. Requests that do not satisfy every requirement are rejected with
+// a 403 insufficient_scope challenge naming the required scopes.
+func (b *BearerAuth) Require(reqs ...Requirement) func(http.Handler) http.Handler {
+	check := AllOf(reqs...)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := ClaimsFromContext(r.Context())
+			if !ok {
+				b.writeError(w, http.StatusUnauthorized, nil, nil)
+				return
+			}
+			if err := check(claims); err != nil {
+				b.writeInsufficientScope(w, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// writeInsufficientScope responds with a 403 insufficient_scope challenge for err
+func (b *BearerAuth) writeInsufficientScope(w http.ResponseWriter, err error) {
+	oauthErr := &OAuth2Error{Code: "insufficient_scope"}
+	var scope []string
+	var scopeErr *InsufficientScopeError
+	if errors.As(err, &scopeErr) {
+		oauthErr.Description = scopeErr.Description
+		scope = scopeErr.Scope
+	}
+	b.writeError(w, http.StatusForbidden, oauthErr, scope)
+}
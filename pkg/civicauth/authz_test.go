@@ -0,0 +1,141 @@
+package civicauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequirements(t *testing.T) {
+	claims := &Claims{
+		Subject:       "user123",
+		Email:         "test@example.com",
+		EmailVerified: true,
+		Scope:         ScopeList{"orders:read", "orders:write"},
+		Roles:         []string{"admin"},
+		Extra: map[string]interface{}{
+			"sub":    "user123",
+			"scope":  "orders:read orders:write",
+			"roles":  []interface{}{"admin"},
+			"tenant": "acme",
+		},
+	}
+
+	tests := []struct {
+		name          string
+		requirement   Requirement
+		expectedScope []string
+	}{
+		{name: "scope", requirement: RequireScope("orders:read")},
+		{name: "all scopes", requirement: RequireScope("orders:read", "orders:write")},
+		{name: "missing scope", requirement: RequireScope("orders:read", "orders:delete"), expectedScope: []string{"orders:read", "orders:delete"}},
+		{name: "any scope", requirement: RequireAnyScope("orders:delete", "orders:write")},
+		{name: "none of the scopes", requirement: RequireAnyScope("billing:read", "billing:write"), expectedScope: []string{"billing:read", "billing:write"}},
+		{name: "claim present", requirement: RequireClaim("tenant")},
+		{name: "claim value", requirement: RequireClaim("tenant", "globex", "acme")},
+		{name: "claim array element", requirement: RequireClaim("roles", "admin")},
+		{name: "wrong claim value", requirement: RequireClaim("tenant", "globex"), expectedScope: []string{}},
+		{name: "missing claim", requirement: RequireClaim("org_id"), expectedScope: []string{}},
+		{name: "email verified", requirement: RequireEmailVerified()},
+		{name: "predicate", requirement: RequireFunc("subject required", func(c *Claims) bool { return c.Subject != "" })},
+		{name: "failing predicate", requirement: RequireFunc("never", func(c *Claims) bool { return false }), expectedScope: []string{}},
+		{name: "all of", requirement: AllOf(RequireScope("orders:read"), RequireClaim("roles", "admin"))},
+		{
+			name:          "all of with failures",
+			requirement:   AllOf(RequireScope("orders:read"), RequireScope("billing:read"), RequireClaim("roles", "auditor")),
+			expectedScope: []string{"billing:read"},
+		},
+		{name: "any of", requirement: AnyOf(RequireScope("billing:read"), RequireClaim("roles", "admin"))},
+		{
+			name:          "any of with failures",
+			requirement:   AnyOf(RequireScope("billing:read"), RequireScope("billing:admin")),
+			expectedScope: []string{"billing:read", "billing:admin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.requirement(claims)
+			if tt.expectedScope == nil {
+				if err != nil {
+					t.Errorf("Expected requirement to be satisfied, got: %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrInsufficientScope) {
+				t.Fatalf("Expected ErrInsufficientScope, got: %v", err)
+			}
+			var scopeErr *InsufficientScopeError
+			if !errors.As(err, &scopeErr) {
+				t.Fatalf("Expected *InsufficientScopeError, got %T", err)
+			}
+			if len(scopeErr.Scope) != len(tt.expectedScope) {
+				t.Fatalf("Expected scope %v, got %v", tt.expectedScope, scopeErr.Scope)
+			}
+			for i, scope := range tt.expectedScope {
+				if scopeErr.Scope[i] != scope {
+					t.Errorf("Expected scope %v, got %v", tt.expectedScope, scopeErr.Scope)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireClaimWithoutExtra(t *testing.T) {
+	claims := &Claims{Subject: "user123", Groups: []string{"engineering"}}
+
+	if err := RequireClaim("groups", "engineering")(claims); err != nil {
+		t.Errorf("Expected struct claims to be matched, got: %v", err)
+	}
+	if err := RequireClaim("email")(claims); err == nil {
+		t.Error("Expected missing email to be rejected")
+	}
+}
+
+func TestBearerAuthRequire(t *testing.T) {
+	auth := newBearerAuth(t, nil, &BearerAuthOptions{
+		Validate: func(ctx context.Context, token string) (*Claims, error) {
+			return &Claims{Subject: "user123", Scope: ScopeList{token}}, nil
+		},
+	})
+	handler := auth.Middleware(auth.Require(RequireScope("orders:write"))(claimsHandler))
+
+	tests := []struct {
+		token          string
+		expectedStatus int
+	}{
+		{token: "orders:write", expectedStatus: http.StatusOK},
+		{token: "orders:read", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/orders", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tt.expectedStatus, rec.Code)
+			}
+			if rec.Code != http.StatusForbidden {
+				return
+			}
+
+			params := parseBearerChallenge(rec.Header().Get("WWW-Authenticate"))
+			if params["error"] != "insufficient_scope" || params["scope"] != "orders:write" {
+				t.Errorf("Expected insufficient_scope challenge for orders:write, got %v", params)
+			}
+		})
+	}
+
+	// Without the authentication middleware there are no claims to check
+	rec := httptest.NewRecorder()
+	auth.Require(RequireScope("orders:write"))(claimsHandler).ServeHTTP(rec, httptest.NewRequest("GET", "/orders", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without authentication, got %d", rec.Code)
+	}
+}
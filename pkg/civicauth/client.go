@@ -11,12 +11,17 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 // Client is the main OIDC client for Civic Auth
 type Client struct {
-	config   *Config
-	provider *OIDCProvider
+	config     *Config
+	provider   *OIDCProvider
+	authMethod string
+
+	// wait pauses between polling requests (default: sleep)
+	wait func(ctx context.Context, d time.Duration) error
 }
 
 // NewClient creates a new Civic Auth OIDC client
@@ -27,6 +32,7 @@ func NewClient(config *Config) (*Client, error) {
 
 	client := &Client{
 		config: config,
+		wait:   sleep,
 	}
 
 	// Discover OIDC provider metadata
@@ -34,6 +40,13 @@ func NewClient(config *Config) (*Client, error) {
 		return nil, fmt.Errorf("failed to discover provider: %w", err)
 	}
 
+	// Choose how the client authenticates at the token endpoint
+	authMethod, err := client.selectAuthMethod()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	client.authMethod = authMethod
+
 	return client, nil
 }
 
@@ -90,26 +103,47 @@ func generateState() (string, error) {
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
+// generateNonce generates a random nonce to bind the ID token to the authorization request
+func generateNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 // AuthCodeURLOptions holds options for generating the authorization URL
 type AuthCodeURLOptions struct {
 	State         string
 	Nonce         string
 	CodeChallenge string
-	Prompt        string // none, login, consent, select_account
-	MaxAge        int    // Maximum age of authentication in seconds
-	LoginHint     string // Hint about the user's identity
+	Prompt        string   // none, login, consent, select_account
+	MaxAge        int      // Maximum age of authentication in seconds
+	LoginHint     string   // Hint about the user's identity
+	ACRValues     []string // Requested authentication context class references
+	RedirectURL   string   // Overrides Config.RedirectURL for this request
 }
 
 // GetAuthCodeURL generates the authorization URL for the OAuth2 flow
 func (c *Client) GetAuthCodeURL(opts *AuthCodeURLOptions) (string, error) {
 	if c.provider == nil {
-		return "", fmt.Errorf("provider not initialized")
+		return "", ErrProviderNotInitialized
+	}
+
+	// Public clients cannot authenticate the code exchange, so PKCE is mandatory
+	if c.config.PublicClient && (opts == nil || opts.CodeChallenge == "") {
+		return "", ErrPKCERequired
+	}
+
+	redirectURL := c.config.RedirectURL
+	if opts != nil && opts.RedirectURL != "" {
+		redirectURL = opts.RedirectURL
 	}
 
 	params := url.Values{
 		"response_type": []string{"code"},
 		"client_id":     []string{c.config.ClientID},
-		"redirect_uri":  []string{c.config.RedirectURL},
+		"redirect_uri":  []string{redirectURL},
 		"scope":         []string{strings.Join(c.config.Scopes, " ")},
 		"response_mode": []string{"query"},
 	}
@@ -135,6 +169,9 @@ func (c *Client) GetAuthCodeURL(opts *AuthCodeURLOptions) (string, error) {
 		if opts.LoginHint != "" {
 			params.Set("login_hint", opts.LoginHint)
 		}
+		if len(opts.ACRValues) > 0 {
+			params.Set("acr_values", strings.Join(opts.ACRValues, " "))
+		}
 	}
 
 	authURL := c.provider.AuthorizationEndpoint + "?" + params.Encode()
@@ -143,43 +180,66 @@ func (c *Client) GetAuthCodeURL(opts *AuthCodeURLOptions) (string, error) {
 
 // ExchangeCodeForTokens exchanges an authorization code for tokens
 func (c *Client) ExchangeCodeForTokens(ctx context.Context, code, codeVerifier string) (*TokenResponse, error) {
+	return c.exchangeCode(ctx, code, codeVerifier, c.config.RedirectURL)
+}
+
+// exchangeCode exchanges an authorization code obtained with the given redirect URL,
+// which must match the redirect_uri of the authorization request
+func (c *Client) exchangeCode(ctx context.Context, code, codeVerifier, redirectURL string) (*TokenResponse, error) {
 	if c.provider == nil {
-		return nil, fmt.Errorf("provider not initialized")
+		return nil, ErrProviderNotInitialized
+	}
+
+	if c.config.PublicClient && codeVerifier == "" {
+		return nil, ErrPKCERequired
 	}
 
 	data := url.Values{
-		"grant_type":    []string{"authorization_code"},
-		"client_id":     []string{c.config.ClientID},
-		"client_secret": []string{c.config.ClientSecret},
-		"code":          []string{code},
-		"redirect_uri":  []string{c.config.RedirectURL},
+		"grant_type":   []string{"authorization_code"},
+		"code":         []string{code},
+		"redirect_uri": []string{redirectURL},
 	}
 
 	if codeVerifier != "" {
 		data.Set("code_verifier", codeVerifier)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", c.provider.TokenEndpoint, strings.NewReader(data.Encode()))
+	tokenResp, err := c.tokenRequest(ctx, data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create token request: %w", err)
+		return nil, fmt.Errorf("token exchange failed: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Accept", "application/json")
+	return tokenResp, nil
+}
 
-	resp, err := c.config.HTTPClient.Do(req)
+// RefreshToken refreshes an access token using a refresh token
+func (c *Client) RefreshToken(ctx context.Context, refreshToken string) (*TokenResponse, error) {
+	if c.provider == nil {
+		return nil, ErrProviderNotInitialized
+	}
+
+	data := url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{refreshToken},
+	}
+
+	tokenResp, err := c.tokenRequest(ctx, data)
 	if err != nil {
-		return nil, fmt.Errorf("token request failed: %w", err)
+		return nil, fmt.Errorf("token refresh failed: %w", err)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	return tokenResp, nil
+}
+
+// tokenRequest sends an authenticated grant request to the token endpoint
+func (c *Client) tokenRequest(ctx context.Context, data url.Values) (*TokenResponse, error) {
+	resp, body, err := c.postForm(ctx, c.provider.TokenEndpoint, data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read token response: %w", err)
+		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("token exchange failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, parseErrorResponse(resp, body)
 	}
 
 	var tokenResp TokenResponse
@@ -190,54 +250,43 @@ func (c *Client) ExchangeCodeForTokens(ctx context.Context, code, codeVerifier s
 	return &tokenResp, nil
 }
 
-// RefreshToken refreshes an access token using a refresh token
-func (c *Client) RefreshToken(ctx context.Context, refreshToken string) (*TokenResponse, error) {
-	if c.provider == nil {
-		return nil, fmt.Errorf("provider not initialized")
-	}
-
-	data := url.Values{
-		"grant_type":    []string{"refresh_token"},
-		"client_id":     []string{c.config.ClientID},
-		"client_secret": []string{c.config.ClientSecret},
-		"refresh_token": []string{refreshToken},
+// postForm sends a form POST to an authorization server endpoint, authenticating the
+// client with the configured token endpoint auth method, and returns the response body
+func (c *Client) postForm(ctx context.Context, endpoint string, data url.Values) (*http.Response, []byte, error) {
+	header := make(http.Header)
+	if err := c.authenticate(endpoint, data, header); err != nil {
+		return nil, nil, fmt.Errorf("failed to authenticate client: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", c.provider.TokenEndpoint, strings.NewReader(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(data.Encode()))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create refresh request: %w", err)
+		return nil, nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
+	for key, values := range header {
+		req.Header[key] = values
+	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("Accept", "application/json")
 
 	resp, err := c.config.HTTPClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("refresh request failed: %w", err)
+		return nil, nil, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read refresh response: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("token refresh failed with status %d: %s", resp.StatusCode, string(body))
-	}
-
-	var tokenResp TokenResponse
-	if err := json.Unmarshal(body, &tokenResp); err != nil {
-		return nil, fmt.Errorf("failed to decode refresh response: %w", err)
+		return nil, nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
-	return &tokenResp, nil
+	return resp, body, nil
 }
 
 // GetUserInfo retrieves user information using an access token
 func (c *Client) GetUserInfo(ctx context.Context, accessToken string) (*UserInfo, error) {
 	if c.provider == nil {
-		return nil, fmt.Errorf("provider not initialized")
+		return nil, ErrProviderNotInitialized
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "GET", c.provider.UserinfoEndpoint, nil)
@@ -260,7 +309,7 @@ func (c *Client) GetUserInfo(ctx context.Context, accessToken string) (*UserInfo
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("userinfo request failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("userinfo request failed: %w", parseErrorResponse(resp, body))
 	}
 
 	var userInfo UserInfo
@@ -295,30 +344,50 @@ func (c *Client) GetLogoutURL(postLogoutRedirectURI, idTokenHint string) (string
 	return logoutURL, nil
 }
 
-// Helper function to create a full authorization flow with PKCE
-func (c *Client) CreateAuthorizationFlow() (authURL, state, codeVerifier string, err error) {
+// CreateAuthorizationFlow creates a full authorization flow with PKCE and a nonce.
+// The state, nonce and code verifier must be kept until the callback is handled:
+// state is compared with the callback parameter, the code verifier is passed to
+// ExchangeCodeForTokens and the nonce is passed to TokenManager.ValidateIDTokenWithNonce.
+func (c *Client) CreateAuthorizationFlow() (authURL, state, nonce, codeVerifier string, err error) {
+	return c.CreateAuthorizationFlowWithOptions(nil)
+}
+
+// CreateAuthorizationFlowWithOptions creates a full authorization flow like
+// CreateAuthorizationFlow, adding the prompt, max_age, login_hint, acr_values and
+// redirect URL from opts. The state, nonce and code challenge in opts are always
+// generated.
+func (c *Client) CreateAuthorizationFlowWithOptions(opts *AuthCodeURLOptions) (authURL, state, nonce, codeVerifier string, err error) {
 	// Generate state parameter
 	state, err = generateState()
 	if err != nil {
-		return "", "", "", fmt.Errorf("failed to generate state: %w", err)
+		return "", "", "", "", fmt.Errorf("failed to generate state: %w", err)
+	}
+
+	// Generate nonce parameter
+	nonce, err = generateNonce()
+	if err != nil {
+		return "", "", "", "", fmt.Errorf("failed to generate nonce: %w", err)
 	}
 
 	// Generate PKCE parameters
 	codeVerifier, codeChallenge, err := generateCodeChallenge()
 	if err != nil {
-		return "", "", "", fmt.Errorf("failed to generate code challenge: %w", err)
+		return "", "", "", "", fmt.Errorf("failed to generate code challenge: %w", err)
 	}
 
 	// Generate authorization URL
-	opts := &AuthCodeURLOptions{
-		State:         state,
-		CodeChallenge: codeChallenge,
+	flowOpts := &AuthCodeURLOptions{}
+	if opts != nil {
+		*flowOpts = *opts
 	}
+	flowOpts.State = state
+	flowOpts.Nonce = nonce
+	flowOpts.CodeChallenge = codeChallenge
 
-	authURL, err = c.GetAuthCodeURL(opts)
+	authURL, err = c.GetAuthCodeURL(flowOpts)
 	if err != nil {
-		return "", "", "", fmt.Errorf("failed to generate auth URL: %w", err)
+		return "", "", "", "", fmt.Errorf("failed to generate auth URL: %w", err)
 	}
 
-	return authURL, state, codeVerifier, nil
+	return authURL, state, nonce, codeVerifier, nil
 }
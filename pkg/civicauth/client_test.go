@@ -0,0 +1,214 @@
+package civicauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testProvider is a minimal OIDC provider used by the package tests
+type testProvider struct {
+	server       *httptest.Server
+	key          *rsa.PrivateKey
+	kid          string
+	extraKeys    []JWK
+	metadata     map[string]interface{}
+	handlers     map[string]http.HandlerFunc
+	jwksRequests int32
+}
+
+// newTestProvider starts a test provider serving discovery metadata and a JWK set.
+// Additional endpoints can be registered in handlers before the client is created.
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+
+	p := &testProvider{
+		key:      key,
+		kid:      "test-key",
+		metadata: make(map[string]interface{}),
+		handlers: make(map[string]http.HandlerFunc),
+	}
+
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler, ok := p.handlers[r.URL.Path]; ok {
+			handler(w, r)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			metadata := map[string]interface{}{
+				"issuer":                 p.server.URL,
+				"authorization_endpoint": p.server.URL + "/authorize",
+				"token_endpoint":         p.server.URL + "/token",
+				"userinfo_endpoint":      p.server.URL + "/userinfo",
+				"jwks_uri":               p.server.URL + "/jwks",
+				"end_session_endpoint":   p.server.URL + "/logout",
+			}
+			for k, v := range p.metadata {
+				metadata[k] = v
+			}
+			writeJSON(w, metadata)
+		case "/jwks":
+			atomic.AddInt32(&p.jwksRequests, 1)
+			writeJSON(w, p.jwks())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+// writeJSON writes v as a JSON response body
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// jwks returns the JWK set containing the provider's public key and any extra keys
+func (p *testProvider) jwks() *JWKSet {
+	keys := []JWK{{
+		Kty: "RSA",
+		Use: "sig",
+		Kid: p.kid,
+		N:   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+	}}
+	return &JWKSet{Keys: append(keys, p.extraKeys...)}
+}
+
+// newClient creates a client for the provider, applying optional config changes
+func (p *testProvider) newClient(t *testing.T, configure func(*Config)) *Client {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.ClientID = "test-client-id"
+	config.ClientSecret = "test-client-secret"
+	config.RedirectURL = "http://localhost:8080/callback"
+	config.Issuer = p.server.URL
+	if configure != nil {
+		configure(config)
+	}
+
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	return client
+}
+
+// idTokenClaims returns a valid set of ID token claims for the default client
+func (p *testProvider) idTokenClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss": p.server.URL,
+		"sub": "user123",
+		"aud": "test-client-id",
+		"exp": now.Add(time.Hour).Unix(),
+		"iat": now.Unix(),
+	}
+}
+
+// signToken signs the claims with the provider's RSA key using RS256
+func (p *testProvider) signToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	return signTestToken(t, jwt.SigningMethodRS256, p.key, p.kid, claims)
+}
+
+// signTestToken signs the claims with the given method, key and key ID
+func signTestToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestCreateAuthorizationFlow(t *testing.T) {
+	provider := newTestProvider(t)
+	client := provider.newClient(t, nil)
+
+	authURL, state, nonce, codeVerifier, err := client.CreateAuthorizationFlow()
+	if err != nil {
+		t.Fatalf("Failed to create authorization flow: %v", err)
+	}
+
+	if state == "" || nonce == "" || codeVerifier == "" {
+		t.Fatal("Expected state, nonce and code verifier to be generated")
+	}
+
+	if state == nonce {
+		t.Error("Expected state and nonce to be independent values")
+	}
+
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("Failed to parse auth URL: %v", err)
+	}
+
+	query := parsed.Query()
+	if query.Get("state") != state {
+		t.Errorf("Expected state %s in auth URL, got %s", state, query.Get("state"))
+	}
+	if query.Get("nonce") != nonce {
+		t.Errorf("Expected nonce %s in auth URL, got %s", nonce, query.Get("nonce"))
+	}
+	if query.Get("code_challenge") == "" {
+		t.Error("Expected code challenge in auth URL")
+	}
+}
+
+func TestCreateAuthorizationFlowWithOptions(t *testing.T) {
+	provider := newTestProvider(t)
+	client := provider.newClient(t, nil)
+
+	authURL, state, nonce, _, err := client.CreateAuthorizationFlowWithOptions(&AuthCodeURLOptions{
+		State:     "ignored-state",
+		MaxAge:    300,
+		ACRValues: []string{"urn:civic:mfa", "urn:civic:hardware-key"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create authorization flow: %v", err)
+	}
+
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("Failed to parse auth URL: %v", err)
+	}
+
+	query := parsed.Query()
+	if state == "ignored-state" || query.Get("state") != state {
+		t.Errorf("Expected generated state in auth URL, got %s", query.Get("state"))
+	}
+	if query.Get("nonce") != nonce {
+		t.Errorf("Expected nonce %s in auth URL, got %s", nonce, query.Get("nonce"))
+	}
+	if query.Get("max_age") != "300" {
+		t.Errorf("Expected max_age 300, got %s", query.Get("max_age"))
+	}
+	if query.Get("acr_values") != "urn:civic:mfa urn:civic:hardware-key" {
+		t.Errorf("Expected acr_values to be space separated, got %s", query.Get("acr_values"))
+	}
+}
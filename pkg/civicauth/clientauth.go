@@ -0,0 +1,322 @@
+package civicauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Token endpoint client authentication methods (OIDC Core section 9)
+const (
+	// AuthMethodClientSecretBasic sends the client credentials with HTTP Basic authentication
+	AuthMethodClientSecretBasic = "client_secret_basic"
+
+	// AuthMethodClientSecretPost sends the client credentials in the request body
+	AuthMethodClientSecretPost = "client_secret_post"
+
+	// AuthMethodClientSecretJWT sends a client assertion signed with the client secret using HS256 (RFC 7523)
+	AuthMethodClientSecretJWT = "client_secret_jwt"
+
+	// AuthMethodPrivateKeyJWT sends a client assertion signed with the client's private key (RFC 7523)
+	AuthMethodPrivateKeyJWT = "private_key_jwt"
+
+	// AuthMethodNone only identifies the client by its client_id
+	AuthMethodNone = "none"
+)
+
+// clientAssertionType is the client_assertion_type for JWT client assertions (RFC 7523 section 2.2)
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// isKnownAuthMethod reports whether the SDK implements the given auth method
+func isKnownAuthMethod(method string) bool {
+	switch method {
+	case AuthMethodClientSecretBasic, AuthMethodClientSecretPost, AuthMethodClientSecretJWT, AuthMethodPrivateKeyJWT, AuthMethodNone:
+		return true
+	}
+	return false
+}
+
+// selectAuthMethod returns the configured token endpoint auth method, or picks one
+// from the provider's token_endpoint_auth_methods_supported. Providers that do not
+// advertise any methods are assumed to support client_secret_basic, the default
+// defined by OIDC Discovery. Public clients use none even when it is not advertised,
+// as many providers accept them with PKCE without listing it.
+func (c *Client) selectAuthMethod() (string, error) {
+	supported := c.provider.TokenEndpointAuthMethodsSupported
+	if len(supported) == 0 {
+		supported = []string{AuthMethodClientSecretBasic}
+	}
+
+	if method := c.config.TokenEndpointAuthMethod; method != "" {
+		if method == AuthMethodNone && c.config.PublicClient {
+			return method, nil
+		}
+		if len(c.provider.TokenEndpointAuthMethodsSupported) > 0 && !containsString(supported, method) {
+			return "", fmt.Errorf("token endpoint auth method %s is not supported by the provider", method)
+		}
+		return method, nil
+	}
+
+	// A configured private key means the client authenticates with private_key_jwt
+	if c.config.PrivateKey != nil {
+		if len(c.provider.TokenEndpointAuthMethodsSupported) > 0 && !containsString(supported, AuthMethodPrivateKeyJWT) {
+			return "", fmt.Errorf("token endpoint auth method %s is not supported by the provider", AuthMethodPrivateKeyJWT)
+		}
+		return AuthMethodPrivateKeyJWT, nil
+	}
+
+	for _, method := range []string{AuthMethodClientSecretBasic, AuthMethodClientSecretPost} {
+		if containsString(supported, method) {
+			return method, nil
+		}
+	}
+
+	return "", fmt.Errorf("provider supports none of the available token endpoint auth methods: %v", supported)
+}
+
+// authenticate adds the client's credentials to a request for the given endpoint,
+// either as form parameters in data or as headers in header
+func (c *Client) authenticate(endpoint string, data url.Values, header http.Header) error {
+	switch c.authMethod {
+	case AuthMethodClientSecretBasic:
+		// RFC 6749 section 2.3.1: credentials are form-urlencoded before base64 encoding
+		credentials := url.QueryEscape(c.config.ClientID) + ":" + url.QueryEscape(c.config.ClientSecret)
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	case AuthMethodClientSecretPost:
+		data.Set("client_id", c.config.ClientID)
+		data.Set("client_secret", c.config.ClientSecret)
+	case AuthMethodClientSecretJWT:
+		assertion, err := c.clientAssertion(jwt.SigningMethodHS256, []byte(c.config.ClientSecret), "", endpoint)
+		if err != nil {
+			return err
+		}
+		setClientAssertion(data, c.config.ClientID, assertion)
+	case AuthMethodPrivateKeyJWT:
+		method, err := signingMethodForKey(c.config.PrivateKey)
+		if err != nil {
+			return err
+		}
+		assertion, err := c.clientAssertion(method, c.config.PrivateKey, c.config.PrivateKeyID, endpoint)
+		if err != nil {
+			return err
+		}
+		setClientAssertion(data, c.config.ClientID, assertion)
+	case AuthMethodNone:
+		data.Set("client_id", c.config.ClientID)
+	default:
+		return fmt.Errorf("unsupported token endpoint auth method %q", c.authMethod)
+	}
+	return nil
+}
+
+// setClientAssertion adds a JWT client assertion to the request parameters
+func setClientAssertion(data url.Values, clientID, assertion string) {
+	data.Set("client_id", clientID)
+	data.Set("client_assertion_type", clientAssertionType)
+	data.Set("client_assertion", assertion)
+}
+
+// clientAssertion creates a short-lived JWT identifying the client to the authorization
+// server, as described in RFC 7523 section 3. Each assertion carries a unique jti so the
+// server can reject replays. The audience is the endpoint being called unless
+// Config.ClientAssertionAudience overrides it.
+func (c *Client) clientAssertion(method jwt.SigningMethod, key interface{}, kid, endpoint string) (string, error) {
+	// The jti only needs to be unique and unpredictable, like the state parameter
+	jti, err := generateState()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate assertion ID: %w", err)
+	}
+
+	audience := endpoint
+	if c.config.ClientAssertionAudience != "" {
+		audience = c.config.ClientAssertionAudience
+	}
+
+	now := c.config.Clock.Now()
+	claims := jwt.MapClaims{
+		"iss": c.config.ClientID,
+		"sub": c.config.ClientID,
+		"aud": audience,
+		"jti": jti,
+		"iat": now.Unix(),
+		"exp": now.Add(c.config.ClientAssertionLifetime).Unix(),
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	assertion, err := token.SignedString(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign client assertion: %w", err)
+	}
+
+	return assertion, nil
+}
+
+// signingMethodForKey returns the JWS algorithm used to sign client assertions with key
+func signingMethodForKey(key crypto.Signer) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("unsupported EC curve %s", k.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// ParsePrivateKeyPEM parses an RSA, EC or Ed25519 private key from PEM data in
+// PKCS #8, PKCS #1 ("RSA PRIVATE KEY") or SEC 1 ("EC PRIVATE KEY") form, for use
+// as Config.PrivateKey
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if _, err := signingMethodForKey(signer); err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+// privateJWK holds the private key parameters of a JWK (RFC 7518 section 6)
+type privateJWK struct {
+	JWK
+	D  string `json:"d"`
+	P  string `json:"p"`
+	Q  string `json:"q"`
+	DP string `json:"dp"`
+	DQ string `json:"dq"`
+	QI string `json:"qi"`
+}
+
+// ParsePrivateKeyJWK parses an RSA, EC or Ed25519 private key from a JSON Web Key,
+// returning the key and its kid for use as Config.PrivateKey and Config.PrivateKeyID
+func ParsePrivateKeyJWK(data []byte) (crypto.Signer, string, error) {
+	var jwk privateJWK
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, "", fmt.Errorf("failed to decode JWK: %w", err)
+	}
+	if jwk.D == "" {
+		return nil, "", fmt.Errorf("JWK does not contain a private key")
+	}
+
+	d, err := base64.RawURLEncoding.DecodeString(jwk.D)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode D parameter: %w", err)
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		publicKey, err := jwkToRSAPublicKey(&jwk.JWK)
+		if err != nil {
+			return nil, "", err
+		}
+
+		p, err := base64.RawURLEncoding.DecodeString(jwk.P)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to decode P parameter: %w", err)
+		}
+		q, err := base64.RawURLEncoding.DecodeString(jwk.Q)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to decode Q parameter: %w", err)
+		}
+
+		key := &rsa.PrivateKey{
+			PublicKey: *publicKey,
+			D:         new(big.Int).SetBytes(d),
+			Primes:    []*big.Int{new(big.Int).SetBytes(p), new(big.Int).SetBytes(q)},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, "", fmt.Errorf("invalid RSA private key: %w", err)
+		}
+		key.Precompute()
+		return key, jwk.Kid, nil
+
+	case "EC":
+		publicKey, err := jwkToECDSAPublicKey(&jwk.JWK)
+		if err != nil {
+			return nil, "", err
+		}
+
+		key := &ecdsa.PrivateKey{PublicKey: *publicKey, D: new(big.Int).SetBytes(d)}
+
+		// Derive the public key from D and compare it with the JWK's coordinates
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid EC private key: %w", err)
+		}
+		ecdhPublic, err := publicKey.ECDH()
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid EC public key: %w", err)
+		}
+		if !ecdhKey.PublicKey().Equal(ecdhPublic) {
+			return nil, "", fmt.Errorf("EC private key does not match public key")
+		}
+		return key, jwk.Kid, nil
+
+	case "OKP":
+		publicKey, err := jwkToEd25519PublicKey(&jwk.JWK)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(d) != ed25519.SeedSize {
+			return nil, "", fmt.Errorf("invalid Ed25519 private key length %d", len(d))
+		}
+
+		key := ed25519.NewKeyFromSeed(d)
+		if !publicKey.Equal(key.Public()) {
+			return nil, "", fmt.Errorf("Ed25519 private key does not match public key")
+		}
+		return key, jwk.Kid, nil
+
+	default:
+		return nil, "", fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
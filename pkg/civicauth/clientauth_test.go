@@ -0,0 +1,413 @@
+package civicauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tokenHandler returns a token endpoint handler that records each request's form
+// and Authorization header before issuing an access token
+func tokenHandler(t *testing.T, requests *[]*http.Request) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Failed to parse token request: %v", err)
+		}
+		*requests = append(*requests, r)
+		writeJSON(w, &TokenResponse{AccessToken: "access-token", TokenType: "Bearer", ExpiresIn: 3600})
+	}
+}
+
+func TestTokenEndpointAuthMethods(t *testing.T) {
+	tests := []struct {
+		name           string
+		supported      []string
+		method         string
+		secret         string
+		expectedMethod string
+		expectError    bool
+	}{
+		{name: "default to basic", secret: "secret", expectedMethod: AuthMethodClientSecretBasic},
+		{name: "select post from discovery", supported: []string{"private_key_jwt", "client_secret_post"}, secret: "secret", expectedMethod: AuthMethodClientSecretPost},
+		{name: "prefer basic from discovery", supported: []string{"client_secret_post", "client_secret_basic"}, secret: "secret", expectedMethod: AuthMethodClientSecretBasic},
+		{name: "configured post", method: AuthMethodClientSecretPost, secret: "secret", expectedMethod: AuthMethodClientSecretPost},
+		{name: "configured none", method: AuthMethodNone, expectedMethod: AuthMethodNone},
+		{name: "configured method not supported", supported: []string{"client_secret_basic"}, method: AuthMethodClientSecretPost, secret: "secret", expectError: true},
+		{name: "no usable method", supported: []string{"tls_client_auth"}, secret: "secret", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestProvider(t)
+			if tt.supported != nil {
+				provider.metadata["token_endpoint_auth_methods_supported"] = tt.supported
+			}
+
+			config := DefaultConfig()
+			config.ClientID = "test-client-id"
+			config.ClientSecret = tt.secret
+			config.TokenEndpointAuthMethod = tt.method
+			config.RedirectURL = "http://localhost:8080/callback"
+			config.Issuer = provider.server.URL
+
+			client, err := NewClient(config)
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error creating client, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+
+			if client.authMethod != tt.expectedMethod {
+				t.Errorf("Expected auth method %s, got %s", tt.expectedMethod, client.authMethod)
+			}
+		})
+	}
+}
+
+func TestTokenRequestClientAuthentication(t *testing.T) {
+	provider := newTestProvider(t)
+	var requests []*http.Request
+	provider.handlers["/token"] = tokenHandler(t, &requests)
+	ctx := context.Background()
+
+	basic := provider.newClient(t, func(c *Config) {
+		c.ClientID = "client:id"
+		c.ClientSecret = "s3cret/+"
+	})
+	if _, err := basic.ExchangeCodeForTokens(ctx, "auth-code", "verifier"); err != nil {
+		t.Fatalf("Token exchange failed: %v", err)
+	}
+
+	username, password, ok := requests[0].BasicAuth()
+	if !ok {
+		t.Fatal("Expected HTTP Basic authentication")
+	}
+	if username != url.QueryEscape("client:id") || password != url.QueryEscape("s3cret/+") {
+		t.Errorf("Expected form-urlencoded credentials, got %s:%s", username, password)
+	}
+	if requests[0].PostForm.Get("client_secret") != "" {
+		t.Error("Expected client secret not to be sent in the body with client_secret_basic")
+	}
+
+	post := provider.newClient(t, func(c *Config) {
+		c.TokenEndpointAuthMethod = AuthMethodClientSecretPost
+	})
+	if _, err := post.RefreshToken(ctx, "refresh-token"); err != nil {
+		t.Fatalf("Token refresh failed: %v", err)
+	}
+
+	if _, _, ok := requests[1].BasicAuth(); ok {
+		t.Error("Expected no HTTP Basic authentication with client_secret_post")
+	}
+	if requests[1].PostForm.Get("client_id") != "test-client-id" || requests[1].PostForm.Get("client_secret") != "test-client-secret" {
+		t.Errorf("Expected client credentials in the body, got %v", requests[1].PostForm)
+	}
+}
+
+func TestPrivateKeyJWTAuthentication(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		key         crypto.Signer
+		expectedAlg string
+	}{
+		{name: "RSA", key: rsaKey, expectedAlg: "RS256"},
+		{name: "EC", key: ecKey, expectedAlg: "ES384"},
+		{name: "Ed25519", key: edKey, expectedAlg: "EdDSA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestProvider(t)
+			provider.metadata["token_endpoint_auth_methods_supported"] = []string{"client_secret_basic", "private_key_jwt"}
+			var requests []*http.Request
+			provider.handlers["/token"] = tokenHandler(t, &requests)
+
+			client := provider.newClient(t, func(c *Config) {
+				c.ClientSecret = ""
+				c.PrivateKey = tt.key
+				c.PrivateKeyID = "client-key"
+			})
+			if client.authMethod != AuthMethodPrivateKeyJWT {
+				t.Fatalf("Expected auth method %s, got %s", AuthMethodPrivateKeyJWT, client.authMethod)
+			}
+
+			ctx := context.Background()
+			for i := 0; i < 2; i++ {
+				if _, err := client.RefreshToken(ctx, "refresh-token"); err != nil {
+					t.Fatalf("Token refresh failed: %v", err)
+				}
+			}
+
+			seen := make(map[string]bool)
+			for _, r := range requests {
+				if r.PostForm.Get("client_assertion_type") != clientAssertionType {
+					t.Errorf("Expected client_assertion_type %s, got %s", clientAssertionType, r.PostForm.Get("client_assertion_type"))
+				}
+				if r.PostForm.Get("client_secret") != "" {
+					t.Error("Expected no client secret with private_key_jwt")
+				}
+
+				claims := jwt.MapClaims{}
+				token, err := jwt.ParseWithClaims(r.PostForm.Get("client_assertion"), claims, func(token *jwt.Token) (interface{}, error) {
+					return tt.key.Public(), nil
+				}, jwt.WithAudience(provider.server.URL+"/token"), jwt.WithIssuer("test-client-id"), jwt.WithSubject("test-client-id"))
+				if err != nil {
+					t.Fatalf("Failed to verify client assertion: %v", err)
+				}
+				if token.Method.Alg() != tt.expectedAlg {
+					t.Errorf("Expected algorithm %s, got %s", tt.expectedAlg, token.Method.Alg())
+				}
+				if token.Header["kid"] != "client-key" {
+					t.Errorf("Expected kid client-key, got %v", token.Header["kid"])
+				}
+
+				jti, _ := claims["jti"].(string)
+				if jti == "" || seen[jti] {
+					t.Errorf("Expected a unique jti, got %q", jti)
+				}
+				seen[jti] = true
+			}
+		})
+	}
+}
+
+func TestClientSecretJWTAuthentication(t *testing.T) {
+	provider := newTestProvider(t)
+	var requests []*http.Request
+	provider.handlers["/token"] = tokenHandler(t, &requests)
+
+	now := time.Now()
+	client := provider.newClient(t, func(c *Config) {
+		c.TokenEndpointAuthMethod = AuthMethodClientSecretJWT
+		c.ClientAssertionLifetime = 30 * time.Second
+		c.ClientAssertionAudience = "https://auth.example.com"
+		c.Clock = fixedClock{now}
+	})
+
+	if _, err := client.ExchangeCodeForTokens(context.Background(), "auth-code", "verifier"); err != nil {
+		t.Fatalf("Token exchange failed: %v", err)
+	}
+
+	form := requests[0].PostForm
+	if form.Get("client_secret") != "" {
+		t.Error("Expected client secret not to be sent with client_secret_jwt")
+	}
+	if _, _, ok := requests[0].BasicAuth(); ok {
+		t.Error("Expected no HTTP Basic authentication with client_secret_jwt")
+	}
+	if form.Get("client_id") != "test-client-id" || form.Get("client_assertion_type") != clientAssertionType {
+		t.Errorf("Expected client_id and client_assertion_type in the body, got %v", form)
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(form.Get("client_assertion"), claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte("test-client-secret"), nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithTimeFunc(func() time.Time { return now }),
+		jwt.WithAudience("https://auth.example.com"), jwt.WithIssuer("test-client-id"))
+	if err != nil {
+		t.Fatalf("Failed to verify client assertion: %v", err)
+	}
+
+	exp, _ := claims.GetExpirationTime()
+	if exp == nil || exp.Unix() != now.Add(30*time.Second).Unix() {
+		t.Errorf("Expected assertion to expire after 30 seconds, got %v", exp)
+	}
+}
+
+func TestPublicClient(t *testing.T) {
+	provider := newTestProvider(t)
+	// Providers often leave none out of the advertised methods
+	provider.metadata["token_endpoint_auth_methods_supported"] = []string{"client_secret_basic", "client_secret_post"}
+	var requests []*http.Request
+	provider.handlers["/token"] = tokenHandler(t, &requests)
+
+	client := provider.newClient(t, func(c *Config) {
+		c.ClientSecret = ""
+		c.PublicClient = true
+	})
+	if client.authMethod != AuthMethodNone {
+		t.Errorf("Expected auth method %s, got %s", AuthMethodNone, client.authMethod)
+	}
+
+	if _, err := client.GetAuthCodeURL(&AuthCodeURLOptions{State: "state"}); !errors.Is(err, ErrPKCERequired) {
+		t.Errorf("Expected ErrPKCERequired without a code challenge, got: %v", err)
+	}
+	if _, _, _, _, err := client.CreateAuthorizationFlow(); err != nil {
+		t.Errorf("Expected authorization flow with PKCE to succeed, got: %v", err)
+	}
+
+	ctx := context.Background()
+	if _, err := client.ExchangeCodeForTokens(ctx, "auth-code", ""); !errors.Is(err, ErrPKCERequired) {
+		t.Errorf("Expected ErrPKCERequired without a code verifier, got: %v", err)
+	}
+	if len(requests) != 0 {
+		t.Fatal("Expected no token request without a code verifier")
+	}
+
+	if _, err := client.ExchangeCodeForTokens(ctx, "auth-code", "verifier"); err != nil {
+		t.Fatalf("Token exchange failed: %v", err)
+	}
+	if _, _, ok := requests[0].BasicAuth(); ok {
+		t.Error("Expected no HTTP Basic authentication for a public client")
+	}
+	form := requests[0].PostForm
+	if form.Get("client_id") != "test-client-id" || form.Get("client_secret") != "" || form.Get("client_assertion") != "" {
+		t.Errorf("Expected only client_id to identify a public client, got %v", form)
+	}
+	if form.Get("code_verifier") != "verifier" {
+		t.Errorf("Expected code_verifier in the token request, got %s", form.Get("code_verifier"))
+	}
+}
+
+func TestParsePrivateKeyPEM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal EC key: %v", err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal Ed25519 key: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		block *pem.Block
+	}{
+		{name: "PKCS #1 RSA", block: &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}},
+		{name: "SEC 1 EC", block: &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}},
+		{name: "PKCS #8 Ed25519", block: &pem.Block{Type: "PRIVATE KEY", Bytes: edDER}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParsePrivateKeyPEM(pem.EncodeToMemory(tt.block)); err != nil {
+				t.Errorf("Failed to parse private key: %v", err)
+			}
+		})
+	}
+
+	if _, err := ParsePrivateKeyPEM([]byte("not a key")); err == nil {
+		t.Error("Expected error for invalid PEM data, got nil")
+	}
+}
+
+func TestParsePrivateKeyJWK(t *testing.T) {
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	otherEC, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+
+	ecPublic := ecJWK("ec-key", "P-256", &ecKey.PublicKey)
+
+	tests := []struct {
+		name        string
+		jwk         map[string]string
+		expectError bool
+	}{
+		{name: "RSA", jwk: map[string]string{
+			"kty": "RSA", "kid": "rsa-key",
+			"n": encode(rsaKey.N.Bytes()), "e": "AQAB", "d": encode(rsaKey.D.Bytes()),
+			"p": encode(rsaKey.Primes[0].Bytes()), "q": encode(rsaKey.Primes[1].Bytes()),
+		}},
+		{name: "EC", jwk: map[string]string{
+			"kty": "EC", "kid": "ec-key", "crv": "P-256", "x": ecPublic.X, "y": ecPublic.Y,
+			"d": encode(ecKey.D.FillBytes(make([]byte, 32))),
+		}},
+		{name: "EC private key for another public key", jwk: map[string]string{
+			"kty": "EC", "kid": "ec-key", "crv": "P-256", "x": ecPublic.X, "y": ecPublic.Y,
+			"d": encode(otherEC.D.FillBytes(make([]byte, 32))),
+		}, expectError: true},
+		{name: "Ed25519", jwk: map[string]string{
+			"kty": "OKP", "kid": "ed-key", "crv": "Ed25519", "x": encode(edPublic), "d": encode(edKey.Seed()),
+		}},
+		{name: "public key only", jwk: map[string]string{
+			"kty": "OKP", "kid": "ed-key", "crv": "Ed25519", "x": encode(edPublic),
+		}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.jwk)
+			if err != nil {
+				t.Fatalf("Failed to marshal JWK: %v", err)
+			}
+
+			key, kid, err := ParsePrivateKeyJWK(data)
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error parsing JWK, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse JWK: %v", err)
+			}
+
+			if kid != tt.jwk["kid"] {
+				t.Errorf("Expected kid %s, got %s", tt.jwk["kid"], kid)
+			}
+			if _, err := signingMethodForKey(key); err != nil {
+				t.Errorf("Expected key usable for client assertions, got: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package civicauth
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultExpiryDelta is how long before expiry a cached token is considered stale
+const defaultExpiryDelta = 30 * time.Second
+
+// ClientCredentialsOptions holds optional parameters for the client credentials grant
+type ClientCredentialsOptions struct {
+	// Scopes to request (default: the scopes the provider grants the client)
+	Scopes []string
+
+	// Resource identifies the APIs the token is intended for (RFC 8707)
+	Resource []string
+}
+
+// ClientCredentials requests a token for the client itself using the client
+// credentials grant (RFC 6749 section 4.4), for machine-to-machine calls
+func (c *Client) ClientCredentials(ctx context.Context, opts *ClientCredentialsOptions) (*TokenResponse, error) {
+	if c.provider == nil {
+		return nil, ErrProviderNotInitialized
+	}
+	if c.config.PublicClient || c.authMethod == AuthMethodNone {
+		return nil, fmt.Errorf("client credentials grant requires a confidential client")
+	}
+
+	data := url.Values{
+		"grant_type": []string{"client_credentials"},
+	}
+
+	if opts != nil {
+		if len(opts.Scopes) > 0 {
+			data.Set("scope", strings.Join(opts.Scopes, " "))
+		}
+		for _, resource := range opts.Resource {
+			data.Add("resource", resource)
+		}
+	}
+
+	tokenResp, err := c.tokenRequest(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("client credentials grant failed: %w", err)
+	}
+
+	return tokenResp, nil
+}
+
+// ClientCredentialsTokenSource caches a client credentials token and reuses it until
+// shortly before it expires. It is safe for concurrent use: when the token needs to
+// be renewed, a single request is made on behalf of all waiting callers.
+type ClientCredentialsTokenSource struct {
+	Client *Client
+
+	// ExpiryDelta renews the token this long before it expires (default: 30 seconds)
+	ExpiryDelta time.Duration
+
+	opts     ClientCredentialsOptions
+	mu       sync.Mutex
+	token    *TokenResponse
+	expiry   time.Time
+	inflight *tokenCall
+}
+
+// tokenCall is an in-flight token request shared by concurrent callers
+type tokenCall struct {
+	*call
+	token *TokenResponse
+}
+
+// NewClientCredentialsTokenSource creates a token source requesting tokens with opts
+func NewClientCredentialsTokenSource(client *Client, opts *ClientCredentialsOptions) *ClientCredentialsTokenSource {
+	ts := &ClientCredentialsTokenSource{
+		Client:      client,
+		ExpiryDelta: defaultExpiryDelta,
+	}
+	if opts != nil {
+		ts.opts = *opts
+	}
+	return ts
+}
+
+// Token returns the cached token, requesting a new one if there is none or it is
+// about to expire. The caller stops waiting when ctx is done, while the request
+// continues for the other callers.
+func (ts *ClientCredentialsTokenSource) Token(ctx context.Context) (*TokenResponse, error) {
+	ts.mu.Lock()
+	if ts.valid() {
+		token := ts.token
+		ts.mu.Unlock()
+		return token, nil
+	}
+
+	fetch := ts.inflight
+	if fetch == nil {
+		fetch = &tokenCall{}
+		fetch.call = startCall(ctx, func(ctx context.Context) (err error) {
+			fetch.token, err = ts.fetch(ctx)
+			return err
+		})
+		ts.inflight = fetch
+	}
+	ts.mu.Unlock()
+
+	if err := fetch.wait(ctx); err != nil {
+		return nil, err
+	}
+	return fetch.token, nil
+}
+
+// fetch requests a new token and caches it for the callers waiting on the request
+func (ts *ClientCredentialsTokenSource) fetch(ctx context.Context) (*TokenResponse, error) {
+	// The lifetime is counted from before the request so the cached expiry errs on the early side
+	issuedAt := ts.Client.config.Clock.Now()
+
+	token, err := ts.Client.ClientCredentials(ctx, &ts.opts)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if err == nil {
+		ts.token = token
+		ts.expiry = time.Time{}
+		if token.ExpiresIn > 0 {
+			ts.expiry = issuedAt.Add(time.Duration(token.ExpiresIn) * time.Second)
+		}
+	}
+	ts.inflight = nil
+	return token, err
+}
+
+// Invalidate discards the cached token, e.g. after an API rejected it, so the next
+// call to Token requests a new one
+func (ts *ClientCredentialsTokenSource) Invalidate() {
+	ts.mu.Lock()
+	ts.token = nil
+	ts.mu.Unlock()
+}
+
+// valid reports whether the cached token can still be used. Tokens without an
+// expires_in are reused until invalidated. The caller must hold ts.mu.
+func (ts *ClientCredentialsTokenSource) valid() bool {
+	if ts.token == nil {
+		return false
+	}
+	if ts.expiry.IsZero() {
+		return true
+	}
+	return ts.Client.config.Clock.Now().Before(ts.expiry.Add(-ts.ExpiryDelta))
+}
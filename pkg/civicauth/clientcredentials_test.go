@@ -0,0 +1,180 @@
+package civicauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientCredentials(t *testing.T) {
+	provider := newTestProvider(t)
+	var requests []*http.Request
+	provider.handlers["/token"] = tokenHandler(t, &requests)
+
+	client := provider.newClient(t, nil)
+	_, err := client.ClientCredentials(context.Background(), &ClientCredentialsOptions{
+		Scopes:   []string{"orders:read", "orders:write"},
+		Resource: []string{"https://api.example.com/orders", "https://api.example.com/billing"},
+	})
+	if err != nil {
+		t.Fatalf("Client credentials grant failed: %v", err)
+	}
+
+	form := requests[0].PostForm
+	if form.Get("grant_type") != "client_credentials" {
+		t.Errorf("Expected grant_type client_credentials, got %s", form.Get("grant_type"))
+	}
+	if form.Get("scope") != "orders:read orders:write" {
+		t.Errorf("Expected space separated scopes, got %s", form.Get("scope"))
+	}
+	if len(form["resource"]) != 2 {
+		t.Errorf("Expected two resource parameters, got %v", form["resource"])
+	}
+	if _, _, ok := requests[0].BasicAuth(); !ok {
+		t.Error("Expected the client to authenticate with HTTP Basic")
+	}
+
+	public := provider.newClient(t, func(c *Config) {
+		c.ClientSecret = ""
+		c.PublicClient = true
+	})
+	if _, err := public.ClientCredentials(context.Background(), nil); err == nil {
+		t.Error("Expected error for a public client, got nil")
+	}
+}
+
+func TestClientCredentialsTokenSource(t *testing.T) {
+	provider := newTestProvider(t)
+	var requests int32
+	provider.handlers["/token"] = func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		writeJSON(w, &TokenResponse{AccessToken: fmt.Sprintf("access-token-%d", n), TokenType: "Bearer", ExpiresIn: 300})
+	}
+
+	clock := &fixedClock{now: time.Now()}
+	client := provider.newClient(t, func(c *Config) {
+		c.Clock = clock
+	})
+	ts := NewClientCredentialsTokenSource(client, nil)
+	ctx := context.Background()
+
+	first, err := ts.Token(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+
+	clock.now = clock.now.Add(4 * time.Minute)
+	cached, err := ts.Token(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	if cached.AccessToken != first.AccessToken || atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("Expected cached token to be reused, got %d requests", requests)
+	}
+
+	// Within ExpiryDelta of expiry the token is renewed
+	clock.now = clock.now.Add(45 * time.Second)
+	renewed, err := ts.Token(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	if renewed.AccessToken == first.AccessToken {
+		t.Error("Expected token to be renewed shortly before expiry")
+	}
+
+	ts.Invalidate()
+	if _, err := ts.Token(ctx); err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	if atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("Expected a new token after Invalidate, got %d requests", requests)
+	}
+}
+
+func TestClientCredentialsTokenSourceConcurrent(t *testing.T) {
+	provider := newTestProvider(t)
+	var requests int32
+	release := make(chan struct{})
+	provider.handlers["/token"] = func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		writeJSON(w, &TokenResponse{AccessToken: "access-token", TokenType: "Bearer", ExpiresIn: 300})
+	}
+
+	ts := NewClientCredentialsTokenSource(provider.newClient(t, nil), nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ts.Token(context.Background()); err != nil {
+				t.Errorf("Failed to get token: %v", err)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected 1 token request for concurrent callers, got %d", n)
+	}
+}
+
+func TestClientCredentialsTokenSourceCancel(t *testing.T) {
+	provider := newTestProvider(t)
+	var requests int32
+	release := make(chan struct{})
+	provider.handlers["/token"] = func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		writeJSON(w, &TokenResponse{AccessToken: "access-token", TokenType: "Bearer", ExpiresIn: 300})
+	}
+
+	ts := NewClientCredentialsTokenSource(provider.newClient(t, nil), nil)
+
+	// The caller that starts the request stops waiting when its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ts.Token(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+
+	// The request continues for other callers
+	result := make(chan error, 1)
+	go func() {
+		token, err := ts.Token(context.Background())
+		if err == nil && token.AccessToken != "access-token" {
+			err = fmt.Errorf("unexpected token %q", token.AccessToken)
+		}
+		result <- err
+	}()
+	close(release)
+	if err := <-result; err != nil {
+		t.Errorf("Failed to get token: %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected 1 token request, got %d", n)
+	}
+}
+
+func TestClientCredentialsTokenSourceError(t *testing.T) {
+	provider := newTestProvider(t)
+	provider.handlers["/token"] = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"invalid_client"}`))
+	}
+
+	ts := NewClientCredentialsTokenSource(provider.newClient(t, nil), nil)
+	if _, err := ts.Token(context.Background()); !errors.Is(err, ErrInvalidClient) {
+		t.Errorf("Expected ErrInvalidClient, got: %v", err)
+	}
+}
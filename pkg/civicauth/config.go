@@ -1,11 +1,29 @@
 package civicauth
 
 import (
+	"crypto"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
+// Clock provides the current time used when evaluating token lifetimes
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is a Clock backed by time.Now
+type systemClock struct{}
+
+// Now returns the current local time
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
 // Config holds the configuration for the Civic Auth OIDC client
 type Config struct {
 	// ClientID is the OAuth2 client ID for your application
@@ -14,6 +32,32 @@ type Config struct {
 	// ClientSecret is the OAuth2 client secret for your application
 	ClientSecret string
 
+	// PublicClient marks a client that cannot keep a secret, such as a CLI or desktop
+	// application. Public clients send no credentials (auth method none), and PKCE is
+	// required for every authorization request and code exchange.
+	PublicClient bool
+
+	// TokenEndpointAuthMethod is how the client authenticates at the token endpoint:
+	// client_secret_basic, client_secret_post, client_secret_jwt, private_key_jwt or
+	// none (default: private_key_jwt when PrivateKey is set, otherwise selected from
+	// the provider's token_endpoint_auth_methods_supported)
+	TokenEndpointAuthMethod string
+
+	// PrivateKey signs client assertions for private_key_jwt: an *rsa.PrivateKey,
+	// *ecdsa.PrivateKey or ed25519.PrivateKey (see ParsePrivateKeyPEM and ParsePrivateKeyJWK)
+	PrivateKey crypto.Signer
+
+	// PrivateKeyID is the key ID (kid) of PrivateKey as registered with the provider
+	PrivateKeyID string
+
+	// ClientAssertionLifetime is how long client_secret_jwt and private_key_jwt
+	// assertions remain valid (default: 1 minute)
+	ClientAssertionLifetime time.Duration
+
+	// ClientAssertionAudience is the aud claim of client assertions (default: the
+	// URL of the endpoint being called)
+	ClientAssertionAudience string
+
 	// RedirectURL is the callback URL where users will be redirected after authentication
 	RedirectURL string
 
@@ -28,15 +72,55 @@ type Config struct {
 
 	// Timeout for HTTP requests (default: 30 seconds)
 	Timeout time.Duration
+
+	// JWKSCacheTTL is how long the provider's signing keys are cached when the JWKS
+	// response carries no Cache-Control or Expires header (default: 1 hour)
+	JWKSCacheTTL time.Duration
+
+	// JWKSMinRefreshInterval is the minimum interval between JWKS fetches triggered
+	// by tokens signed with an unknown key ID (default: 1 minute)
+	JWKSMinRefreshInterval time.Duration
+
+	// AllowedAlgorithms pins the JWS algorithms accepted for ID token signatures
+	// (default: the provider's id_token_signing_alg_values_supported, or RS256)
+	AllowedAlgorithms []string
+
+	// ClockSkew is the leeway allowed when checking exp, nbf, iat and auth_time,
+	// to account for clock differences between servers (default: 1 minute). A
+	// negative value disables the leeway.
+	ClockSkew time.Duration
+
+	// MaxTokenAge rejects ID tokens issued longer ago than this duration (optional)
+	MaxTokenAge time.Duration
+
+	// Clock provides the current time for token validation (default: system clock)
+	Clock Clock
+
+	// TrustedAudiences are additional audiences that may appear in an ID token
+	// alongside the ClientID (optional)
+	TrustedAudiences []string
 }
 
 // DefaultConfig returns a Config with sensible defaults
 func DefaultConfig() *Config {
 	return &Config{
-		Scopes:     []string{"openid", "profile", "email"},
-		HTTPClient: &http.Client{},
-		Timeout:    30 * time.Second,
+		Scopes:                  []string{"openid", "profile", "email"},
+		HTTPClient:              &http.Client{},
+		Timeout:                 30 * time.Second,
+		ClientAssertionLifetime: time.Minute,
+		JWKSCacheTTL:            time.Hour,
+		JWKSMinRefreshInterval:  time.Minute,
+		ClockSkew:               time.Minute,
+		Clock:                   systemClock{},
+	}
+}
+
+// leeway returns the clock skew allowed when checking token times
+func (c *Config) leeway() time.Duration {
+	if c.ClockSkew < 0 {
+		return 0
 	}
+	return c.ClockSkew
 }
 
 // Validate checks that the configuration is valid
@@ -44,8 +128,38 @@ func (c *Config) Validate() error {
 	if c.ClientID == "" {
 		return fmt.Errorf("client ID is required")
 	}
-	if c.ClientSecret == "" {
-		return fmt.Errorf("client secret is required")
+	if c.TokenEndpointAuthMethod != "" && !isKnownAuthMethod(c.TokenEndpointAuthMethod) {
+		return fmt.Errorf("unsupported token endpoint auth method %q", c.TokenEndpointAuthMethod)
+	}
+	if c.PublicClient {
+		if c.ClientSecret != "" || c.PrivateKey != nil {
+			return fmt.Errorf("public clients must not have a client secret or private key")
+		}
+		if c.TokenEndpointAuthMethod != "" && c.TokenEndpointAuthMethod != AuthMethodNone {
+			return fmt.Errorf("public clients must use token endpoint auth method %s", AuthMethodNone)
+		}
+		c.TokenEndpointAuthMethod = AuthMethodNone
+	}
+	switch c.TokenEndpointAuthMethod {
+	case AuthMethodNone:
+		// No client credentials are sent
+	case AuthMethodPrivateKeyJWT:
+		if c.PrivateKey == nil {
+			return fmt.Errorf("private key is required for %s", AuthMethodPrivateKeyJWT)
+		}
+	case AuthMethodClientSecretBasic, AuthMethodClientSecretPost, AuthMethodClientSecretJWT:
+		if c.ClientSecret == "" {
+			return fmt.Errorf("client secret is required")
+		}
+	default:
+		if c.ClientSecret == "" && c.PrivateKey == nil {
+			return fmt.Errorf("client secret is required")
+		}
+	}
+	if c.PrivateKey != nil {
+		if _, err := signingMethodForKey(c.PrivateKey); err != nil {
+			return fmt.Errorf("invalid private key: %w", err)
+		}
 	}
 	if c.RedirectURL == "" {
 		return fmt.Errorf("redirect URL is required")
@@ -53,6 +167,14 @@ func (c *Config) Validate() error {
 	if c.Issuer == "" {
 		return fmt.Errorf("issuer URL is required")
 	}
+	for _, alg := range c.AllowedAlgorithms {
+		if isInsecureAlgorithm(alg) {
+			return fmt.Errorf("algorithm %q cannot be allowed for token signatures", alg)
+		}
+		if jwt.GetSigningMethod(alg) == nil {
+			return fmt.Errorf("unsupported signing algorithm %q", alg)
+		}
+	}
 	if len(c.Scopes) == 0 {
 		c.Scopes = []string{"openid", "profile", "email"}
 	}
@@ -62,6 +184,21 @@ func (c *Config) Validate() error {
 	if c.Timeout == 0 {
 		c.Timeout = 30 * time.Second
 	}
+	if c.ClientAssertionLifetime == 0 {
+		c.ClientAssertionLifetime = time.Minute
+	}
+	if c.JWKSCacheTTL == 0 {
+		c.JWKSCacheTTL = time.Hour
+	}
+	if c.JWKSMinRefreshInterval == 0 {
+		c.JWKSMinRefreshInterval = time.Minute
+	}
+	if c.ClockSkew == 0 {
+		c.ClockSkew = time.Minute
+	}
+	if c.Clock == nil {
+		c.Clock = systemClock{}
+	}
 
 	c.HTTPClient.Timeout = c.Timeout
 
@@ -76,6 +213,13 @@ type OIDCProvider struct {
 	UserinfoEndpoint      string `json:"userinfo_endpoint"`
 	JwksURI               string `json:"jwks_uri"`
 	EndSessionEndpoint    string `json:"end_session_endpoint,omitempty"`
+
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint,omitempty"`
+	RevocationEndpoint          string `json:"revocation_endpoint,omitempty"`
+	IntrospectionEndpoint       string `json:"introspection_endpoint,omitempty"`
+
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported,omitempty"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported,omitempty"`
 }
 
 // TokenResponse represents the OAuth2 token response
@@ -86,6 +230,9 @@ type TokenResponse struct {
 	TokenType    string `json:"token_type"`
 	ExpiresIn    int    `json:"expires_in"`
 	Scope        string `json:"scope,omitempty"`
+
+	// IssuedTokenType is the type of the token issued by a token exchange (RFC 8693)
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
 }
 
 // UserInfo represents the OIDC user information
@@ -111,16 +258,100 @@ type UserInfo struct {
 	UpdatedAt         int64  `json:"updated_at,omitempty"`
 }
 
-// Claims represents ID token claims
+// Audience represents the aud claim, which may be a single string or an array of strings
+type Audience []string
+
+// UnmarshalJSON accepts both the string and array forms of the aud claim
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	// A null aud is treated as absent rather than as a single empty audience
+	if string(data) == "null" {
+		*a = nil
+		return nil
+	}
+
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return fmt.Errorf("aud must be a string or an array of strings")
+	}
+
+	*a = Audience(multiple)
+	return nil
+}
+
+// MarshalJSON encodes a single audience as a string and multiple audiences as an array
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// Contains reports whether the audience includes the given value
+func (a Audience) Contains(aud string) bool {
+	return containsString(a, aud)
+}
+
+// ScopeList holds OAuth2 scopes, encoded in JSON as a space-delimited string
+// (RFC 6749 section 3.3). Arrays are accepted as well, as some providers emit them.
+type ScopeList []string
+
+// UnmarshalJSON accepts a space-delimited string or an array of scopes
+func (s *ScopeList) UnmarshalJSON(data []byte) error {
+	var delimited string
+	if err := json.Unmarshal(data, &delimited); err == nil {
+		*s = ScopeList(strings.Fields(delimited))
+		return nil
+	}
+
+	var scopes []string
+	if err := json.Unmarshal(data, &scopes); err != nil {
+		return fmt.Errorf("scope must be a string or an array of strings")
+	}
+
+	*s = ScopeList(scopes)
+	return nil
+}
+
+// MarshalJSON encodes the scopes as a space-delimited string
+func (s ScopeList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strings.Join(s, " "))
+}
+
+// Contains reports whether the list includes the given scope
+func (s ScopeList) Contains(scope string) bool {
+	return containsString(s, scope)
+}
+
+// Claims represents ID token and JWT access token claims
 type Claims struct {
-	Issuer       string `json:"iss"`
-	Subject      string `json:"sub"`
-	Audience     string `json:"aud"`
-	Expiry       int64  `json:"exp"`
-	IssuedAt     int64  `json:"iat"`
-	Nonce        string `json:"nonce,omitempty"`
-	AuthTime     int64  `json:"auth_time,omitempty"`
-	SessionState string `json:"session_state,omitempty"`
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        Audience `json:"aud"`
+	AuthorizedParty string   `json:"azp,omitempty"`
+	Expiry          int64    `json:"exp"`
+	NotBefore       int64    `json:"nbf,omitempty"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce,omitempty"`
+	AuthTime        int64    `json:"auth_time,omitempty"`
+	ACR             string   `json:"acr,omitempty"`
+	AMR             []string `json:"amr,omitempty"`
+	AccessTokenHash string   `json:"at_hash,omitempty"`
+	CodeHash        string   `json:"c_hash,omitempty"`
+	SessionState    string   `json:"session_state,omitempty"`
+
+	// JWT access token claims (RFC 9068)
+	JWTID        string    `json:"jti,omitempty"`
+	ClientID     string    `json:"client_id,omitempty"`
+	Scope        ScopeList `json:"scope,omitempty"`
+	Roles        []string  `json:"roles,omitempty"`
+	Groups       []string  `json:"groups,omitempty"`
+	Entitlements []string  `json:"entitlements,omitempty"`
 
 	// Standard profile claims
 	Name              string `json:"name,omitempty"`
@@ -141,4 +372,7 @@ type Claims struct {
 	PhoneNumber       string `json:"phone_number,omitempty"`
 	PhoneVerified     bool   `json:"phone_number_verified,omitempty"`
 	UpdatedAt         int64  `json:"updated_at,omitempty"`
+
+	// Extra holds every claim of the token, including custom ones
+	Extra map[string]interface{} `json:"-"`
 }
@@ -1,6 +1,7 @@
 package civicauth
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 )
@@ -66,6 +67,80 @@ func TestConfigValidation(t *testing.T) {
 			},
 			expectError: true,
 		},
+		{
+			name: "auth method none without client secret",
+			config: &Config{
+				ClientID:                "test-client-id",
+				TokenEndpointAuthMethod: AuthMethodNone,
+				RedirectURL:             "http://localhost:8080/callback",
+				Issuer:                  "https://auth.civic.com",
+			},
+			expectError: false,
+		},
+		{
+			name: "private_key_jwt without private key",
+			config: &Config{
+				ClientID:                "test-client-id",
+				ClientSecret:            "test-client-secret",
+				TokenEndpointAuthMethod: AuthMethodPrivateKeyJWT,
+				RedirectURL:             "http://localhost:8080/callback",
+				Issuer:                  "https://auth.civic.com",
+			},
+			expectError: true,
+		},
+		{
+			name: "client_secret_jwt without client secret",
+			config: &Config{
+				ClientID:                "test-client-id",
+				TokenEndpointAuthMethod: AuthMethodClientSecretJWT,
+				RedirectURL:             "http://localhost:8080/callback",
+				Issuer:                  "https://auth.civic.com",
+			},
+			expectError: true,
+		},
+		{
+			name: "public client",
+			config: &Config{
+				ClientID:     "test-client-id",
+				PublicClient: true,
+				RedirectURL:  "http://localhost:8080/callback",
+				Issuer:       "https://auth.civic.com",
+			},
+			expectError: false,
+		},
+		{
+			name: "public client with client secret",
+			config: &Config{
+				ClientID:     "test-client-id",
+				ClientSecret: "test-client-secret",
+				PublicClient: true,
+				RedirectURL:  "http://localhost:8080/callback",
+				Issuer:       "https://auth.civic.com",
+			},
+			expectError: true,
+		},
+		{
+			name: "public client with client_secret_post",
+			config: &Config{
+				ClientID:                "test-client-id",
+				PublicClient:            true,
+				TokenEndpointAuthMethod: AuthMethodClientSecretPost,
+				RedirectURL:             "http://localhost:8080/callback",
+				Issuer:                  "https://auth.civic.com",
+			},
+			expectError: true,
+		},
+		{
+			name: "unknown auth method",
+			config: &Config{
+				ClientID:                "test-client-id",
+				ClientSecret:            "test-client-secret",
+				TokenEndpointAuthMethod: "client_secret_magic",
+				RedirectURL:             "http://localhost:8080/callback",
+				Issuer:                  "https://auth.civic.com",
+			},
+			expectError: true,
+		},
 		{
 			name: "missing redirect URL",
 			config: &Config{
@@ -75,6 +150,28 @@ func TestConfigValidation(t *testing.T) {
 			},
 			expectError: true,
 		},
+		{
+			name: "insecure allowed algorithm",
+			config: &Config{
+				ClientID:          "test-client-id",
+				ClientSecret:      "test-client-secret",
+				RedirectURL:       "http://localhost:8080/callback",
+				Issuer:            "https://auth.civic.com",
+				AllowedAlgorithms: []string{"RS256", "HS256"},
+			},
+			expectError: true,
+		},
+		{
+			name: "unknown allowed algorithm",
+			config: &Config{
+				ClientID:          "test-client-id",
+				ClientSecret:      "test-client-secret",
+				RedirectURL:       "http://localhost:8080/callback",
+				Issuer:            "https://auth.civic.com",
+				AllowedAlgorithms: []string{"XX256"},
+			},
+			expectError: true,
+		},
 		{
 			name: "missing issuer",
 			config: &Config{
@@ -127,4 +224,93 @@ func TestConfigDefaults(t *testing.T) {
 	if config.Timeout != 30*time.Second {
 		t.Error("Expected default timeout to be set")
 	}
+
+	if config.ClockSkew != time.Minute {
+		t.Errorf("Expected default clock skew of 1m, got %v", config.ClockSkew)
+	}
+
+	if config.Clock == nil {
+		t.Error("Expected Clock to be initialized")
+	}
+}
+
+func TestAudienceJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected Audience
+	}{
+		{name: "string", input: `"client-a"`, expected: Audience{"client-a"}},
+		{name: "array", input: `["client-a","client-b"]`, expected: Audience{"client-a", "client-b"}},
+		{name: "null", input: `null`, expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var aud Audience
+			if err := json.Unmarshal([]byte(tt.input), &aud); err != nil {
+				t.Fatalf("Failed to unmarshal audience: %v", err)
+			}
+
+			if len(aud) != len(tt.expected) {
+				t.Fatalf("Expected %d audiences, got %d", len(tt.expected), len(aud))
+			}
+			for i := range tt.expected {
+				if aud[i] != tt.expected[i] {
+					t.Errorf("Expected audience %s at index %d, got %s", tt.expected[i], i, aud[i])
+				}
+			}
+
+			encoded, err := json.Marshal(aud)
+			if err != nil {
+				t.Fatalf("Failed to marshal audience: %v", err)
+			}
+			if string(encoded) != tt.input {
+				t.Errorf("Expected %s, got %s", tt.input, encoded)
+			}
+		})
+	}
+
+	var aud Audience
+	if err := json.Unmarshal([]byte(`123`), &aud); err == nil {
+		t.Error("Expected error for numeric audience, got nil")
+	}
+}
+
+func TestScopeListJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected ScopeList
+	}{
+		{name: "space delimited", input: `"openid  orders:read"`, expected: ScopeList{"openid", "orders:read"}},
+		{name: "array", input: `["openid","orders:read"]`, expected: ScopeList{"openid", "orders:read"}},
+		{name: "empty", input: `""`, expected: ScopeList{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var scopes ScopeList
+			if err := json.Unmarshal([]byte(tt.input), &scopes); err != nil {
+				t.Fatalf("Failed to unmarshal scopes: %v", err)
+			}
+
+			if len(scopes) != len(tt.expected) {
+				t.Fatalf("Expected %d scopes, got %d", len(tt.expected), len(scopes))
+			}
+			for i := range tt.expected {
+				if !scopes.Contains(tt.expected[i]) {
+					t.Errorf("Expected scope %s", tt.expected[i])
+				}
+			}
+		})
+	}
+
+	encoded, err := json.Marshal(ScopeList{"openid", "orders:read"})
+	if err != nil {
+		t.Fatalf("Failed to marshal scopes: %v", err)
+	}
+	if string(encoded) != `"openid orders:read"` {
+		t.Errorf("Expected space-delimited scopes, got %s", encoded)
+	}
 }
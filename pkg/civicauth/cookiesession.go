@@ -0,0 +1,367 @@
+package civicauth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxCookieChunkLength keeps each cookie, including its name and attributes,
+	// below the 4096 byte limit of browsers
+	maxCookieChunkLength = 3800
+
+	// maxCookieChunks bounds how many cookies a sealed value may be split across
+	maxCookieChunks = 8
+
+	// cookieTouchInterval is how often loading a cookie session reseals it to extend
+	// its idle timeout
+	cookieTouchInterval = time.Minute
+)
+
+// defaultCookieClaims are the ID token claims kept by CookieSessionStore by default
+var defaultCookieClaims = []string{
+	"iss", "sub", "aud", "exp", "iat", "auth_time", "acr", "amr", "sid",
+	"name", "preferred_username", "email", "email_verified",
+}
+
+// CookieKey is a key sealing cookies with AES-GCM
+type CookieKey struct {
+	// ID identifies the key in sealed cookies, so that keys can be rotated
+	ID string
+
+	// Secret is a random AES key of 16, 24 or 32 bytes
+	Secret []byte
+}
+
+// GenerateCookieKey creates a random 256-bit cookie key with the given ID
+func GenerateCookieKey(id string) (CookieKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return CookieKey{}, fmt.Errorf("failed to generate cookie key: %w", err)
+	}
+	return CookieKey{ID: id, Secret: secret}, nil
+}
+
+// cookieSealer encrypts and authenticates cookie values. The first key seals new
+// values and every key opens them.
+type cookieSealer struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// newCookieSealer checks keys and prepares their ciphers
+func newCookieSealer(keys []CookieKey) (*cookieSealer, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("at least one cookie key is required")
+	}
+
+	s := &cookieSealer{
+		primary: keys[0].ID,
+		aeads:   make(map[string]cipher.AEAD, len(keys)),
+	}
+	for _, key := range keys {
+		if key.ID == "" || strings.Contains(key.ID, ".") {
+			return nil, fmt.Errorf("invalid cookie key ID %q", key.ID)
+		}
+		if _, ok := s.aeads[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate cookie key ID %q", key.ID)
+		}
+
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cookie key %q: %w", key.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cookie key %q: %w", key.ID, err)
+		}
+		s.aeads[key.ID] = aead
+	}
+	return s, nil
+}
+
+// seal encrypts plaintext for the named cookie as "<key ID>.<nonce and ciphertext>".
+// The cookie name is authenticated, so a value cannot be moved to another cookie.
+func (s *cookieSealer) seal(name string, plaintext []byte) (string, error) {
+	aead := s.aeads[s.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(name))
+	return s.primary + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value sealed for the named cookie
+func (s *cookieSealer) open(name, value string) ([]byte, error) {
+	keyID, encoded, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, ErrInvalidCookie
+	}
+	aead, ok := s.aeads[keyID]
+	if !ok {
+		return nil, ErrInvalidCookie
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, ErrInvalidCookie
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, ErrInvalidCookie
+	}
+	return plaintext, nil
+}
+
+// chunkName returns the name of the cookie holding chunk i of a value
+func chunkName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return name + "." + strconv.Itoa(i)
+}
+
+// readChunkedCookie reassembles a value split across cookies by writeChunkedCookie
+func readChunkedCookie(r *http.Request, name string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < maxCookieChunks; i++ {
+		cookie, err := r.Cookie(chunkName(name, i))
+		if err != nil {
+			break
+		}
+		b.WriteString(cookie.Value)
+	}
+	return b.String(), b.Len() > 0
+}
+
+// writeChunkedCookie sets value in cookies based on template, splitting it into
+// chunks that fit the browser's cookie size limit, and expires chunks left over from
+// a longer value
+func writeChunkedCookie(w http.ResponseWriter, r *http.Request, template *http.Cookie, value string) error {
+	chunks := (len(value) + maxCookieChunkLength - 1) / maxCookieChunkLength
+	if chunks > maxCookieChunks {
+		return fmt.Errorf("cookie value of %d bytes is too large", len(value))
+	}
+
+	for i := 0; i < chunks; i++ {
+		cookie := *template
+		cookie.Name = chunkName(template.Name, i)
+		cookie.Value = value[i*maxCookieChunkLength : min((i+1)*maxCookieChunkLength, len(value))]
+		http.SetCookie(w, &cookie)
+	}
+	clearChunkedCookie(w, r, template.Name, template.Secure, chunks)
+	return nil
+}
+
+// clearChunkedCookie expires the chunks of the named cookie sent with the request,
+// starting from chunk from
+func clearChunkedCookie(w http.ResponseWriter, r *http.Request, name string, secure bool, from int) {
+	for i := from; i < maxCookieChunks; i++ {
+		if _, err := r.Cookie(chunkName(name, i)); err == nil {
+			clearCookie(w, chunkName(name, i), secure)
+		}
+	}
+}
+
+// CookieSessionStore is a SessionStore keeping the whole session in cookies sealed
+// with AES-GCM, so that no server-side storage is needed. Sessions larger than a
+// cookie are split across several cookies. Since a copy of the cookies stays valid
+// until the session times out, Delete cannot revoke a session that was copied.
+type CookieSessionStore struct {
+	opts   SessionOptions
+	sealer *cookieSealer
+}
+
+// NewCookieSessionStore creates a cookie session store. The first of keys seals
+// sessions and every key opens them, so keys can be rotated by adding a new key in
+// front and removing the old one once its sessions have expired.
+func NewCookieSessionStore(keys []CookieKey, opts *SessionOptions) (*CookieSessionStore, error) {
+	sealer, err := newCookieSealer(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &CookieSessionStore{
+		opts:   newSessionOptions(opts),
+		sealer: sealer,
+	}
+	if s.opts.CookieClaims == nil {
+		s.opts.CookieClaims = defaultCookieClaims
+	}
+	return s, nil
+}
+
+// cookieSessionData is the sealed form of a Session, keeping only the selected claims
+type cookieSessionData struct {
+	Session
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// Load opens the session cookies. Cookies that fail to decrypt are cleared and
+// reported as ErrSessionNotFound wrapping ErrInvalidCookie.
+func (s *CookieSessionStore) Load(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	value, ok := readChunkedCookie(r, s.opts.CookieName)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	session, err := s.open(value)
+	if err != nil {
+		clearChunkedCookie(w, r, s.opts.CookieName, s.opts.secure(), 0)
+		return nil, fmt.Errorf("%w: %w", ErrSessionNotFound, err)
+	}
+	if s.opts.expired(session) {
+		clearChunkedCookie(w, r, s.opts.CookieName, s.opts.secure(), 0)
+		return nil, ErrSessionNotFound
+	}
+
+	// Reseal the session now and then to extend its idle timeout
+	if s.opts.Clock.Now().Sub(session.LastSeen) >= cookieTouchInterval {
+		if err := s.Save(w, r, session); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// Save seals session, with its tokens and the selected claims, into the session cookies
+func (s *CookieSessionStore) Save(w http.ResponseWriter, r *http.Request, session *Session) error {
+	if err := s.opts.prepare(session); err != nil {
+		return err
+	}
+
+	data := cookieSessionData{Session: *session}
+	data.Session.Claims = nil
+	if session.Claims != nil {
+		data.Claims = make(map[string]interface{})
+		for _, name := range s.opts.CookieClaims {
+			if value, ok := claimValue(session.Claims, name); ok {
+				data.Claims[name] = value
+			}
+		}
+	}
+
+	plaintext, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+	value, err := s.sealer.seal(s.opts.CookieName, plaintext)
+	if err != nil {
+		return fmt.Errorf("failed to seal session: %w", err)
+	}
+
+	if err := writeChunkedCookie(w, r, s.opts.cookie(s.opts.CookieName, "", session.Expiry), value); err != nil {
+		return fmt.Errorf("failed to write session cookie: %w", err)
+	}
+	return nil
+}
+
+// Delete clears the session cookies
+func (s *CookieSessionStore) Delete(w http.ResponseWriter, r *http.Request) error {
+	clearChunkedCookie(w, r, s.opts.CookieName, s.opts.secure(), 0)
+	return nil
+}
+
+// open decrypts and decodes a sealed session
+func (s *CookieSessionStore) open(value string) (*Session, error) {
+	plaintext, err := s.sealer.open(s.opts.CookieName, value)
+	if err != nil {
+		return nil, err
+	}
+
+	var data cookieSessionData
+	if err := json.Unmarshal(plaintext, &data); err != nil {
+		return nil, fmt.Errorf("failed to decode session: %w", err)
+	}
+
+	session := data.Session
+	if data.Claims != nil {
+		claimsJSON, err := json.Marshal(data.Claims)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode session claims: %w", err)
+		}
+		session.Claims = &Claims{}
+		if err := json.Unmarshal(claimsJSON, session.Claims); err != nil {
+			return nil, fmt.Errorf("failed to decode session claims: %w", err)
+		}
+		session.Claims.Extra = data.Claims
+	}
+	return &session, nil
+}
+
+// CookieFlowStore is a FlowStore keeping pending authorization flows in a cookie
+// sealed with AES-GCM, for use with CookieSessionStore when there is no server-side
+// storage. A flow cookie is cleared when the callback takes it and expires with the flow.
+type CookieFlowStore struct {
+	opts   FlowStoreOptions
+	sealer *cookieSealer
+}
+
+// NewCookieFlowStore creates a cookie flow store sealing flows with the first of keys
+func NewCookieFlowStore(keys []CookieKey, opts *FlowStoreOptions) (*CookieFlowStore, error) {
+	sealer, err := newCookieSealer(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &CookieFlowStore{sealer: sealer}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.CookieName == "" {
+		s.opts.CookieName = defaultFlowCookieName
+	}
+	return s, nil
+}
+
+// Save seals flow into the flow cookie
+func (s *CookieFlowStore) Save(w http.ResponseWriter, r *http.Request, flow *AuthFlow) error {
+	plaintext, err := json.Marshal(flow)
+	if err != nil {
+		return fmt.Errorf("failed to encode flow: %w", err)
+	}
+	value, err := s.sealer.seal(s.opts.CookieName, plaintext)
+	if err != nil {
+		return fmt.Errorf("failed to seal flow: %w", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.opts.CookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  flow.Expiry,
+		Secure:   s.opts.secure(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Take opens the flow cookie and clears it
+func (s *CookieFlowStore) Take(w http.ResponseWriter, r *http.Request) (*AuthFlow, error) {
+	cookie, err := r.Cookie(s.opts.CookieName)
+	if err != nil {
+		return nil, ErrFlowNotFound
+	}
+	clearCookie(w, s.opts.CookieName, s.opts.secure())
+
+	plaintext, err := s.sealer.open(s.opts.CookieName, cookie.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFlowNotFound, err)
+	}
+	var flow AuthFlow
+	if err := json.Unmarshal(plaintext, &flow); err != nil {
+		return nil, fmt.Errorf("failed to decode flow: %w", err)
+	}
+	return &flow, nil
+}
@@ -0,0 +1,322 @@
+package civicauth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCookieKey returns a fixed cookie key with the given ID
+func testCookieKey(id string) CookieKey {
+	return CookieKey{ID: id, Secret: []byte(strings.Repeat(id, 32)[:32])}
+}
+
+// newCookieSessionStore creates a cookie session store or fails the test
+func newCookieSessionStore(t *testing.T, keys []CookieKey, opts *SessionOptions) *CookieSessionStore {
+	t.Helper()
+	store, err := NewCookieSessionStore(keys, opts)
+	if err != nil {
+		t.Fatalf("Failed to create cookie session store: %v", err)
+	}
+	return store
+}
+
+// saveCookieSession saves session in store and returns the cookies it set
+func saveCookieSession(t *testing.T, store SessionStore, r *http.Request, session *Session) []*http.Cookie {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if err := store.Save(rec, r, session); err != nil {
+		t.Fatalf("Failed to save session: %v", err)
+	}
+	return rec.Result().Cookies()
+}
+
+// loadCookieSession loads the session from store with the given cookies
+func loadCookieSession(store SessionStore, cookies []*http.Cookie) (*Session, *httptest.ResponseRecorder, error) {
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		if cookie.MaxAge >= 0 {
+			r.AddCookie(cookie)
+		}
+	}
+	rec := httptest.NewRecorder()
+	session, err := store.Load(rec, r)
+	return session, rec, err
+}
+
+func TestCookieSessionStore(t *testing.T) {
+	store := newCookieSessionStore(t, []CookieKey{testCookieKey("k1")}, nil)
+
+	cookies := saveCookieSession(t, store, httptest.NewRequest("GET", "/", nil), &Session{
+		Subject: "user123",
+		Tokens:  &TokenResponse{AccessToken: "access-token", RefreshToken: "refresh-token"},
+		Claims: &Claims{
+			Subject:       "user123",
+			Email:         "test@example.com",
+			EmailVerified: true,
+			PhoneNumber:   "+15555550100",
+			Extra:         map[string]interface{}{"sub": "user123", "email": "test@example.com", "email_verified": true, "sid": "provider-session"},
+		},
+	})
+
+	if len(cookies) != 1 {
+		t.Fatalf("Expected a single session cookie, got %d", len(cookies))
+	}
+	cookie := cookies[0]
+	if !cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Expires.IsZero() {
+		t.Errorf("Expected Secure, HttpOnly, SameSite=Lax cookie expiring with the session, got %+v", cookie)
+	}
+	if strings.Contains(cookie.Value, "access-token") || !strings.HasPrefix(cookie.Value, "k1.") {
+		t.Errorf("Expected an encrypted cookie sealed with key k1, got %s", cookie.Value)
+	}
+
+	session, _, err := loadCookieSession(store, cookies)
+	if err != nil {
+		t.Fatalf("Failed to load session: %v", err)
+	}
+	if session.Subject != "user123" || session.Tokens.RefreshToken != "refresh-token" {
+		t.Errorf("Unexpected session: %+v", session)
+	}
+	if session.Claims.Email != "test@example.com" || !session.Claims.EmailVerified || session.Claims.Extra["sid"] != "provider-session" {
+		t.Errorf("Expected the selected claims, got %+v", session.Claims)
+	}
+	if session.Claims.PhoneNumber != "" {
+		t.Errorf("Expected claims outside CookieClaims to be dropped, got %s", session.Claims.PhoneNumber)
+	}
+}
+
+func TestCookieSessionStoreChunking(t *testing.T) {
+	store := newCookieSessionStore(t, []CookieKey{testCookieKey("k1")}, nil)
+
+	large := &Session{Subject: "user123", Tokens: &TokenResponse{AccessToken: strings.Repeat("a", 9000)}}
+	cookies := saveCookieSession(t, store, httptest.NewRequest("GET", "/", nil), large)
+	if len(cookies) != 4 {
+		t.Fatalf("Expected the session to be split across 4 cookies, got %d", len(cookies))
+	}
+	for _, cookie := range cookies {
+		if len(cookie.String()) > 4096 {
+			t.Errorf("Expected cookie %s to fit in 4096 bytes, got %d", cookie.Name, len(cookie.String()))
+		}
+	}
+
+	session, _, err := loadCookieSession(store, cookies)
+	if err != nil || session.Tokens.AccessToken != large.Tokens.AccessToken {
+		t.Fatalf("Failed to load chunked session: %v", err)
+	}
+
+	// Saving a smaller session expires the chunks it no longer needs
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	session.Tokens = &TokenResponse{AccessToken: "access-token"}
+	smaller := saveCookieSession(t, store, r, session)
+	var cleared int
+	for _, cookie := range smaller {
+		if cookie.MaxAge < 0 {
+			cleared++
+		}
+	}
+	if cleared != 3 {
+		t.Errorf("Expected 3 leftover chunks to be cleared, got %d", cleared)
+	}
+
+	huge := &Session{Tokens: &TokenResponse{AccessToken: strings.Repeat("a", 40000)}}
+	if err := store.Save(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), huge); err == nil {
+		t.Error("Expected error saving a session too large for the cookie limit")
+	}
+}
+
+func TestCookieSessionStoreTampering(t *testing.T) {
+	store := newCookieSessionStore(t, []CookieKey{testCookieKey("k1")}, nil)
+	cookies := saveCookieSession(t, store, httptest.NewRequest("GET", "/", nil), &Session{Subject: "user123"})
+	value := cookies[0].Value
+
+	flows, err := NewCookieFlowStore([]CookieKey{testCookieKey("k1")}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create cookie flow store: %v", err)
+	}
+	flowRec := httptest.NewRecorder()
+	if err := flows.Save(flowRec, httptest.NewRequest("GET", "/", nil), &AuthFlow{State: "state", Expiry: time.Now().Add(time.Minute)}); err != nil {
+		t.Fatalf("Failed to save flow: %v", err)
+	}
+
+	flipped := []byte(value)
+	flipped[len(flipped)-5] ^= 1
+
+	tests := map[string]string{
+		"modified ciphertext": string(flipped),
+		"unknown key":         "k2" + strings.TrimPrefix(value, "k1"),
+		"missing key ID":      strings.TrimPrefix(value, "k1."),
+		"truncated":           value[:10],
+		"flow cookie":         flowRec.Result().Cookies()[0].Value,
+	}
+
+	for name, tampered := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, rec, err := loadCookieSession(store, []*http.Cookie{{Name: "civicauth_session", Value: tampered}})
+			if !errors.Is(err, ErrSessionNotFound) || !errors.Is(err, ErrInvalidCookie) {
+				t.Errorf("Expected ErrSessionNotFound and ErrInvalidCookie, got: %v", err)
+			}
+			if cookie := responseCookie(rec, "civicauth_session"); cookie == nil || cookie.MaxAge >= 0 {
+				t.Errorf("Expected the invalid cookie to be cleared, got %+v", cookie)
+			}
+		})
+	}
+}
+
+func TestCookieSessionStoreKeyRotation(t *testing.T) {
+	old := newCookieSessionStore(t, []CookieKey{testCookieKey("k1")}, nil)
+	rotated := newCookieSessionStore(t, []CookieKey{testCookieKey("k2"), testCookieKey("k1")}, nil)
+	retired := newCookieSessionStore(t, []CookieKey{testCookieKey("k2")}, nil)
+
+	oldCookies := saveCookieSession(t, old, httptest.NewRequest("GET", "/", nil), &Session{Subject: "user123"})
+
+	session, _, err := loadCookieSession(rotated, oldCookies)
+	if err != nil {
+		t.Fatalf("Expected a session sealed with an older key to load, got: %v", err)
+	}
+	newCookies := saveCookieSession(t, rotated, httptest.NewRequest("GET", "/", nil), session)
+	if !strings.HasPrefix(newCookies[0].Value, "k2.") {
+		t.Errorf("Expected the session to be resealed with k2, got %s", newCookies[0].Value)
+	}
+
+	if _, _, err := loadCookieSession(retired, oldCookies); !errors.Is(err, ErrInvalidCookie) {
+		t.Errorf("Expected sessions sealed with a removed key to be rejected, got: %v", err)
+	}
+	if _, _, err := loadCookieSession(retired, newCookies); err != nil {
+		t.Errorf("Expected the resealed session to load, got: %v", err)
+	}
+}
+
+func TestCookieSessionStoreTimeouts(t *testing.T) {
+	start := time.Now()
+	clock := &fixedClock{now: start}
+	store := newCookieSessionStore(t, []CookieKey{testCookieKey("k1")}, &SessionOptions{
+		IdleTimeout: 10 * time.Minute,
+		Clock:       clock,
+	})
+	cookies := saveCookieSession(t, store, httptest.NewRequest("GET", "/", nil), &Session{Subject: "user123"})
+
+	// Loading within the touch interval does not rewrite the cookie
+	clock.now = start.Add(30 * time.Second)
+	if _, rec, err := loadCookieSession(store, cookies); err != nil || len(rec.Result().Cookies()) != 0 {
+		t.Fatalf("Expected the session to load without a new cookie, got %v", err)
+	}
+
+	// Later loads reseal the session with a new last seen time
+	clock.now = start.Add(8 * time.Minute)
+	_, rec, err := loadCookieSession(store, cookies)
+	if err != nil || len(rec.Result().Cookies()) != 1 {
+		t.Fatalf("Expected the session to be resealed, got %v", err)
+	}
+	touched := rec.Result().Cookies()
+
+	clock.now = start.Add(16 * time.Minute)
+	if _, _, err := loadCookieSession(store, cookies); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected the original cookie to be idle, got: %v", err)
+	}
+	if _, _, err := loadCookieSession(store, touched); err != nil {
+		t.Errorf("Expected the resealed cookie to be active, got: %v", err)
+	}
+}
+
+func TestNewCookieSessionStoreErrors(t *testing.T) {
+	tests := map[string][]CookieKey{
+		"no keys":      nil,
+		"short secret": {{ID: "k1", Secret: []byte("short")}},
+		"missing ID":   {{Secret: make([]byte, 32)}},
+		"ID with dot":  {{ID: "k.1", Secret: make([]byte, 32)}},
+		"duplicate ID": {testCookieKey("k1"), testCookieKey("k1")},
+	}
+
+	for name, keys := range tests {
+		if _, err := NewCookieSessionStore(keys, nil); err == nil {
+			t.Errorf("%s: expected error creating cookie session store", name)
+		}
+	}
+
+	if key, err := GenerateCookieKey("k1"); err != nil || len(key.Secret) != 32 {
+		t.Errorf("Expected a 256-bit generated key, got %d bytes, %v", len(key.Secret), err)
+	}
+}
+
+func TestCookieStoresSecure(t *testing.T) {
+	keys := []CookieKey{testCookieKey("k1")}
+	insecure := false
+
+	for _, tt := range []struct {
+		name     string
+		secure   *bool
+		expected bool
+	}{
+		{name: "default", expected: true},
+		{name: "opted out", secure: &insecure, expected: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := newCookieSessionStore(t, keys, &SessionOptions{Secure: tt.secure})
+			cookies := saveCookieSession(t, sessions, httptest.NewRequest("GET", "/", nil), &Session{Subject: "user123"})
+			if cookies[0].Secure != tt.expected {
+				t.Errorf("Expected session cookie Secure=%v, got %v", tt.expected, cookies[0].Secure)
+			}
+
+			flows, err := NewCookieFlowStore(keys, &FlowStoreOptions{Secure: tt.secure})
+			if err != nil {
+				t.Fatalf("Failed to create cookie flow store: %v", err)
+			}
+			rec := httptest.NewRecorder()
+			if err := flows.Save(rec, httptest.NewRequest("GET", "/", nil), &AuthFlow{State: "state", Expiry: time.Now().Add(time.Minute)}); err != nil {
+				t.Fatalf("Failed to save flow: %v", err)
+			}
+			if cookie := responseCookie(rec, "civicauth_flow"); cookie == nil || cookie.Secure != tt.expected {
+				t.Errorf("Expected flow cookie Secure=%v, got %+v", tt.expected, cookie)
+			}
+		})
+	}
+}
+
+func TestAuthHandlerWithCookieStores(t *testing.T) {
+	provider, nonce := webProvider(t)
+	client := provider.newClient(t, nil)
+	keys := []CookieKey{testCookieKey("k1")}
+
+	// Two instances sharing only the keys, as behind a load balancer
+	newHandler := func() *AuthHandler {
+		sessions := newCookieSessionStore(t, keys, nil)
+		flows, err := NewCookieFlowStore(keys, nil)
+		if err != nil {
+			t.Fatalf("Failed to create cookie flow store: %v", err)
+		}
+		return NewAuthHandler(client, sessions, &AuthHandlerOptions{FlowStore: flows})
+	}
+	first, second := newHandler(), newHandler()
+
+	authQuery, cookies := login(t, first, "/login?return_to=/orders", nonce)
+	rec := serve(second, "/callback?code=auth-code&state="+authQuery.Get("state"), cookies)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/orders" {
+		t.Fatalf("Expected redirect to /orders, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	r := httptest.NewRequest("GET", "/orders", nil)
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.MaxAge >= 0 {
+			r.AddCookie(cookie)
+		}
+	}
+	session, err := first.Session(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("Failed to get session: %v", err)
+	}
+	if session.Subject != "user123" || session.Tokens.IDToken == "" || session.Claims.Subject != "user123" {
+		t.Errorf("Expected tokens and claims in the cookie session, got %+v", session)
+	}
+
+	// The sealed flow cannot be replayed once the callback cleared it, nor used
+	// without the state it was issued for
+	if rec := serve(second, "/callback?code=auth-code&state=forged", cookies); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected forged state to be rejected, got status %d", rec.Code)
+	}
+}
@@ -0,0 +1,141 @@
+package civicauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// deviceCodeGrantType is the grant_type for polling with a device code (RFC 8628 section 3.4)
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// defaultDevicePollInterval is used when the provider does not return an interval
+	defaultDevicePollInterval = 5
+
+	// slowDownIncrement is added to the polling interval on every slow_down error
+	slowDownIncrement = 5
+)
+
+// DeviceAuthorizationOptions holds optional parameters for a device authorization request
+type DeviceAuthorizationOptions struct {
+	// Scopes to request (default: Config.Scopes)
+	Scopes []string
+}
+
+// DeviceAuthorizationResponse is the provider's response to a device authorization
+// request (RFC 8628 section 3.2)
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval,omitempty"`
+}
+
+// StartDeviceAuthorization begins the Device Authorization Grant (RFC 8628) for
+// devices that cannot open a browser. Show the user the UserCode and VerificationURI
+// (or VerificationURIComplete, e.g. as a QR code), then call PollDeviceToken.
+func (c *Client) StartDeviceAuthorization(ctx context.Context, opts *DeviceAuthorizationOptions) (*DeviceAuthorizationResponse, error) {
+	if c.provider == nil {
+		return nil, ErrProviderNotInitialized
+	}
+	if c.provider.DeviceAuthorizationEndpoint == "" {
+		return nil, fmt.Errorf("device authorization endpoint not available")
+	}
+
+	scopes := c.config.Scopes
+	if opts != nil && len(opts.Scopes) > 0 {
+		scopes = opts.Scopes
+	}
+
+	data := url.Values{
+		"client_id": []string{c.config.ClientID},
+		"scope":     []string{strings.Join(scopes, " ")},
+	}
+
+	resp, body, err := c.postForm(ctx, c.provider.DeviceAuthorizationEndpoint, data)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization failed: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device authorization failed: %w", parseErrorResponse(resp, body))
+	}
+
+	var deviceResp DeviceAuthorizationResponse
+	if err := json.Unmarshal(body, &deviceResp); err != nil {
+		return nil, fmt.Errorf("failed to decode device authorization response: %w", err)
+	}
+	if deviceResp.DeviceCode == "" || deviceResp.UserCode == "" || deviceResp.VerificationURI == "" {
+		return nil, fmt.Errorf("device authorization response is missing required fields")
+	}
+
+	return &deviceResp, nil
+}
+
+// sleep waits for d, or returns the context's error if ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// PollDeviceToken polls the token endpoint until the user approves or denies the
+// device authorization, waiting the provider's interval between requests and
+// backing off on slow_down. It returns ErrAccessDenied if the user declined,
+// ErrExpiredToken once the device code expires, or the context's error if ctx is
+// done first.
+func (c *Client) PollDeviceToken(ctx context.Context, auth *DeviceAuthorizationResponse) (*TokenResponse, error) {
+	if c.provider == nil {
+		return nil, ErrProviderNotInitialized
+	}
+
+	interval := auth.Interval
+	if interval <= 0 {
+		interval = defaultDevicePollInterval
+	}
+
+	var expiry time.Time
+	if auth.ExpiresIn > 0 {
+		expiry = c.config.Clock.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	}
+
+	data := url.Values{
+		"grant_type":  []string{deviceCodeGrantType},
+		"device_code": []string{auth.DeviceCode},
+	}
+
+	for {
+		if err := c.wait(ctx, time.Duration(interval)*time.Second); err != nil {
+			return nil, err
+		}
+		if !expiry.IsZero() && !c.config.Clock.Now().Before(expiry) {
+			return nil, fmt.Errorf("device authorization failed: %w", ErrExpiredToken)
+		}
+
+		tokenResp, err := c.tokenRequest(ctx, data)
+		switch {
+		case err == nil:
+			return tokenResp, nil
+		case errors.Is(err, ErrAuthorizationPending):
+			continue
+		case errors.Is(err, ErrSlowDown):
+			interval += slowDownIncrement
+			continue
+		default:
+			return nil, fmt.Errorf("device authorization failed: %w", err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package civicauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newDevicePollingClient creates a client that waits between polling requests by
+// advancing its clock instead of sleeping, and records the waits
+func newDevicePollingClient(t *testing.T, provider *testProvider, waits *[]time.Duration) *Client {
+	clock := &fixedClock{now: time.Now()}
+	client := provider.newClient(t, func(c *Config) {
+		c.Clock = clock
+	})
+	client.wait = func(ctx context.Context, d time.Duration) error {
+		*waits = append(*waits, d)
+		clock.now = clock.now.Add(d)
+		return ctx.Err()
+	}
+	return client
+}
+
+// deviceTokenHandler returns a token endpoint handler that answers successive
+// requests with the given error codes, then issues a token
+func deviceTokenHandler(t *testing.T, codes []string, times *[]time.Time) http.HandlerFunc {
+	var mu sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.PostFormValue("grant_type") != deviceCodeGrantType || r.PostFormValue("device_code") != "device-code" {
+			t.Errorf("Unexpected device token request: %v", r.PostForm)
+		}
+
+		n := len(*times)
+		*times = append(*times, time.Now())
+		if n < len(codes) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": codes[n]})
+			return
+		}
+		writeJSON(w, &TokenResponse{AccessToken: "access-token", TokenType: "Bearer", ExpiresIn: 3600})
+	}
+}
+
+func TestStartDeviceAuthorization(t *testing.T) {
+	provider := newTestProvider(t)
+	provider.metadata["device_authorization_endpoint"] = provider.server.URL + "/device"
+	provider.handlers["/device"] = func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("client_id") != "test-client-id" {
+			t.Errorf("Expected client_id in device authorization request, got %s", r.PostFormValue("client_id"))
+		}
+		if r.PostFormValue("scope") != "openid offline_access" {
+			t.Errorf("Expected requested scopes, got %s", r.PostFormValue("scope"))
+		}
+		writeJSON(w, map[string]interface{}{
+			"device_code":               "device-code",
+			"user_code":                 "WDJB-MJHT",
+			"verification_uri":          "https://auth.example.com/device",
+			"verification_uri_complete": "https://auth.example.com/device?user_code=WDJB-MJHT",
+			"expires_in":                1800,
+			"interval":                  5,
+		})
+	}
+
+	client := provider.newClient(t, nil)
+	auth, err := client.StartDeviceAuthorization(context.Background(), &DeviceAuthorizationOptions{
+		Scopes: []string{"openid", "offline_access"},
+	})
+	if err != nil {
+		t.Fatalf("Device authorization failed: %v", err)
+	}
+
+	if auth.UserCode != "WDJB-MJHT" || auth.VerificationURIComplete == "" || auth.Interval != 5 {
+		t.Errorf("Unexpected device authorization response: %+v", auth)
+	}
+
+	delete(provider.metadata, "device_authorization_endpoint")
+	withoutDevice := provider.newClient(t, nil)
+	if _, err := withoutDevice.StartDeviceAuthorization(context.Background(), nil); err == nil {
+		t.Error("Expected error without a device authorization endpoint, got nil")
+	}
+}
+
+func TestPollDeviceToken(t *testing.T) {
+	provider := newTestProvider(t)
+	var times []time.Time
+	provider.handlers["/token"] = deviceTokenHandler(t, []string{"authorization_pending", "slow_down", "authorization_pending"}, &times)
+
+	var waits []time.Duration
+	client := newDevicePollingClient(t, provider, &waits)
+	tokens, err := client.PollDeviceToken(context.Background(), &DeviceAuthorizationResponse{
+		DeviceCode: "device-code",
+		ExpiresIn:  1000,
+		Interval:   1,
+	})
+	if err != nil {
+		t.Fatalf("Device token polling failed: %v", err)
+	}
+
+	if tokens.AccessToken != "access-token" {
+		t.Errorf("Expected access token, got %s", tokens.AccessToken)
+	}
+	if len(times) != 4 {
+		t.Fatalf("Expected 4 token requests, got %d", len(times))
+	}
+	expected := []time.Duration{time.Second, time.Second, 6 * time.Second, 6 * time.Second}
+	if fmt.Sprint(waits) != fmt.Sprint(expected) {
+		t.Errorf("Expected waits %v increasing by 5 seconds after slow_down, got %v", expected, waits)
+	}
+}
+
+func TestPollDeviceTokenErrors(t *testing.T) {
+	pending := make([]string, 1000)
+	for i := range pending {
+		pending[i] = "authorization_pending"
+	}
+
+	tests := []struct {
+		name      string
+		codes     []string
+		expiresIn int
+		expected  error
+	}{
+		{name: "access denied", codes: []string{"authorization_pending", "access_denied"}, expiresIn: 1000, expected: ErrAccessDenied},
+		{name: "expired token", codes: []string{"expired_token"}, expiresIn: 1000, expected: ErrExpiredToken},
+		{name: "device code lifetime elapsed", codes: pending, expiresIn: 20, expected: ErrExpiredToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestProvider(t)
+			var times []time.Time
+			provider.handlers["/token"] = deviceTokenHandler(t, tt.codes, &times)
+
+			var waits []time.Duration
+			client := newDevicePollingClient(t, provider, &waits)
+			_, err := client.PollDeviceToken(context.Background(), &DeviceAuthorizationResponse{
+				DeviceCode: "device-code",
+				ExpiresIn:  tt.expiresIn,
+				Interval:   1,
+			})
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("Expected %v, got: %v", tt.expected, err)
+			}
+		})
+	}
+
+	t.Run("context cancelled", func(t *testing.T) {
+		provider := newTestProvider(t)
+		var times []time.Time
+		provider.handlers["/token"] = deviceTokenHandler(t, nil, &times)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		client := provider.newClient(t, nil)
+		_, err := client.PollDeviceToken(ctx, &DeviceAuthorizationResponse{DeviceCode: "device-code", Interval: 1})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got: %v", err)
+		}
+		if len(times) != 0 {
+			t.Errorf("Expected no token requests after cancellation, got %d", len(times))
+		}
+	})
+}
@@ -0,0 +1,224 @@
+package civicauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxErrorBodyLength limits how much of a non-JSON error body is kept in OAuth2Error
+const maxErrorBodyLength = 512
+
+var (
+	// ErrProviderNotInitialized is returned when the provider metadata has not been discovered
+	ErrProviderNotInitialized = errors.New("provider not initialized")
+
+	// ErrInsecureAlgorithm is returned when a token is signed with "none" or an HMAC algorithm
+	ErrInsecureAlgorithm = errors.New("insecure signing algorithm")
+
+	// ErrAlgorithmNotAllowed is returned when a token is signed with an algorithm outside the allowlist
+	ErrAlgorithmNotAllowed = errors.New("signing algorithm not allowed")
+
+	// ErrPKCERequired is returned when a public client builds an authorization URL
+	// without a code challenge or exchanges a code without a code verifier
+	ErrPKCERequired = errors.New("PKCE is required for public clients")
+
+	// ErrFlowNotFound is returned by a FlowStore when the request has no pending
+	// authorization flow
+	ErrFlowNotFound = errors.New("authorization flow not found")
+
+	// ErrSessionNotFound is returned by a SessionStore when the request has no session
+	// or its session expired
+	ErrSessionNotFound = errors.New("session not found")
+
+	// ErrInvalidCookie is returned when a sealed cookie fails to decrypt, because it
+	// was tampered with or sealed with an unknown key
+	ErrInvalidCookie = errors.New("invalid cookie")
+)
+
+// Sentinel errors for the standard OAuth2 error codes (RFC 6749 section 5.2 and
+// RFC 6750 section 3.1). They match any *OAuth2Error with the same code:
+//
+//	if errors.Is(err, civicauth.ErrInvalidGrant) {
+//		// The authorization code or refresh token is no longer valid
+//	}
+var (
+	ErrInvalidRequest         = &OAuth2Error{Code: "invalid_request"}
+	ErrInvalidClient          = &OAuth2Error{Code: "invalid_client"}
+	ErrInvalidGrant           = &OAuth2Error{Code: "invalid_grant"}
+	ErrUnauthorizedClient     = &OAuth2Error{Code: "unauthorized_client"}
+	ErrUnsupportedGrantType   = &OAuth2Error{Code: "unsupported_grant_type"}
+	ErrInvalidScope           = &OAuth2Error{Code: "invalid_scope"}
+	ErrAccessDenied           = &OAuth2Error{Code: "access_denied"}
+	ErrServerError            = &OAuth2Error{Code: "server_error"}
+	ErrTemporarilyUnavailable = &OAuth2Error{Code: "temporarily_unavailable"}
+	ErrInvalidToken           = &OAuth2Error{Code: "invalid_token"}
+	ErrInsufficientScope      = &OAuth2Error{Code: "insufficient_scope"}
+
+	// Device Authorization Grant errors (RFC 8628 section 3.5)
+	ErrAuthorizationPending = &OAuth2Error{Code: "authorization_pending"}
+	ErrSlowDown             = &OAuth2Error{Code: "slow_down"}
+	ErrExpiredToken         = &OAuth2Error{Code: "expired_token"}
+
+	// Token exchange error for an unacceptable audience or resource (RFC 8693 section 2.2.2)
+	ErrInvalidTarget = &OAuth2Error{Code: "invalid_target"}
+
+	// Revocation error for a token type the server cannot revoke (RFC 7009 section 2.2.1)
+	ErrUnsupportedTokenType = &OAuth2Error{Code: "unsupported_token_type"}
+)
+
+// OAuth2Error is an error response returned by the authorization server or a
+// protected resource, parsed from an RFC 6749 JSON error body or an RFC 6750
+// WWW-Authenticate header
+type OAuth2Error struct {
+	// Code is the error code, e.g. invalid_grant (empty if the response had none)
+	Code string
+
+	// Description is the human-readable error_description, or the start of the
+	// response body when the response was not an OAuth2 error
+	Description string
+
+	// URI is the error_uri pointing to more information about the error
+	URI string
+
+	// StatusCode is the HTTP status code of the response (0 for sentinel errors)
+	StatusCode int
+
+	// RetryAfter is the delay requested by the Retry-After header, if any
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface
+func (e *OAuth2Error) Error() string {
+	var b strings.Builder
+	b.WriteString("oauth2: ")
+
+	if e.Code != "" {
+		b.WriteString(e.Code)
+	} else {
+		b.WriteString("request failed")
+	}
+	if e.Description != "" {
+		b.WriteString(": ")
+		b.WriteString(e.Description)
+	}
+	if e.StatusCode != 0 {
+		fmt.Fprintf(&b, " (status %d)", e.StatusCode)
+	}
+
+	return b.String()
+}
+
+// Is reports whether target is an OAuth2Error with the same error code, so that
+// errors.Is matches the sentinel errors regardless of description or status
+func (e *OAuth2Error) Is(target error) bool {
+	t, ok := target.(*OAuth2Error)
+	return ok && t.Code != "" && t.Code == e.Code
+}
+
+// Retryable reports whether the request may succeed if retried later: the server
+// reported a temporary condition, rate limiting, or an internal error
+func (e *OAuth2Error) Retryable() bool {
+	switch e.Code {
+	case "temporarily_unavailable", "server_error":
+		return true
+	}
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+// parseErrorResponse builds an OAuth2Error from an unsuccessful response, reading the
+// error from the JSON body or, failing that, from a Bearer WWW-Authenticate header
+func parseErrorResponse(resp *http.Response, body []byte) *OAuth2Error {
+	oauthErr := &OAuth2Error{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	var errResp struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+		ErrorURI         string `json:"error_uri"`
+	}
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error != "" {
+		oauthErr.Code = errResp.Error
+		oauthErr.Description = errResp.ErrorDescription
+		oauthErr.URI = errResp.ErrorURI
+		return oauthErr
+	}
+
+	if params := parseBearerChallenge(resp.Header.Get("WWW-Authenticate")); params["error"] != "" {
+		oauthErr.Code = params["error"]
+		oauthErr.Description = params["error_description"]
+		oauthErr.URI = params["error_uri"]
+		return oauthErr
+	}
+
+	description := strings.TrimSpace(string(body))
+	if len(description) > maxErrorBodyLength {
+		description = description[:maxErrorBodyLength]
+	}
+	oauthErr.Description = description
+
+	return oauthErr
+}
+
+// parseBearerChallenge extracts the auth-params of a Bearer challenge from a
+// WWW-Authenticate header value, e.g. Bearer realm="example", error="invalid_token"
+func parseBearerChallenge(header string) map[string]string {
+	params := make(map[string]string)
+
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return params
+	}
+
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimLeft(value, " ")
+
+		if strings.HasPrefix(value, `"`) {
+			// Quoted string with backslash escapes
+			var b strings.Builder
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				b.WriteByte(value[i])
+			}
+			params[key] = b.String()
+			rest = strings.TrimPrefix(strings.TrimSpace(value[min(i+1, len(value)):]), ",")
+			continue
+		}
+
+		token, remainder, _ := strings.Cut(value, ",")
+		params[key] = strings.TrimSpace(token)
+		rest = remainder
+	}
+
+	return params
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
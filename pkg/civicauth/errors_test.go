@@ -0,0 +1,107 @@
+package civicauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseErrorResponse(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		header        http.Header
+		body          string
+		expectedCode  string
+		expectedDesc  string
+		expectedRetry bool
+	}{
+		{
+			name:         "JSON error body",
+			status:       http.StatusBadRequest,
+			header:       http.Header{},
+			body:         `{"error":"invalid_grant","error_description":"Code expired","error_uri":"https://example.com/errors"}`,
+			expectedCode: "invalid_grant",
+			expectedDesc: "Code expired",
+		},
+		{
+			name:         "WWW-Authenticate bearer error",
+			status:       http.StatusUnauthorized,
+			header:       http.Header{"Www-Authenticate": {`Bearer realm="civic", error="invalid_token", error_description="The access token \"expired\""`}},
+			expectedCode: "invalid_token",
+			expectedDesc: `The access token "expired"`,
+		},
+		{
+			name:          "temporarily unavailable",
+			status:        http.StatusServiceUnavailable,
+			header:        http.Header{"Retry-After": {"30"}},
+			body:          `{"error":"temporarily_unavailable"}`,
+			expectedCode:  "temporarily_unavailable",
+			expectedRetry: true,
+		},
+		{
+			name:          "non-JSON server error",
+			status:        http.StatusInternalServerError,
+			header:        http.Header{},
+			body:          "upstream connect error",
+			expectedDesc:  "upstream connect error",
+			expectedRetry: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: tt.header}
+			oauthErr := parseErrorResponse(resp, []byte(tt.body))
+
+			if oauthErr.Code != tt.expectedCode {
+				t.Errorf("Expected code %q, got %q", tt.expectedCode, oauthErr.Code)
+			}
+			if oauthErr.Description != tt.expectedDesc {
+				t.Errorf("Expected description %q, got %q", tt.expectedDesc, oauthErr.Description)
+			}
+			if oauthErr.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, oauthErr.StatusCode)
+			}
+			if oauthErr.Retryable() != tt.expectedRetry {
+				t.Errorf("Expected retryable %t, got %t", tt.expectedRetry, oauthErr.Retryable())
+			}
+		})
+	}
+
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"30"}}}
+	if retryAfter := parseErrorResponse(resp, nil).RetryAfter; retryAfter != 30*time.Second {
+		t.Errorf("Expected Retry-After of 30s, got %v", retryAfter)
+	}
+}
+
+func TestTokenErrorsAreTyped(t *testing.T) {
+	provider := newTestProvider(t)
+	provider.handlers["/token"] = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant","error_description":"Refresh token revoked"}`))
+	}
+	client := provider.newClient(t, nil)
+
+	_, err := client.RefreshToken(context.Background(), "revoked-token")
+	if !errors.Is(err, ErrInvalidGrant) {
+		t.Fatalf("Expected ErrInvalidGrant, got: %v", err)
+	}
+	if errors.Is(err, ErrInvalidClient) {
+		t.Error("Expected error not to match ErrInvalidClient")
+	}
+
+	var oauthErr *OAuth2Error
+	if !errors.As(err, &oauthErr) {
+		t.Fatalf("Expected *OAuth2Error, got %T", err)
+	}
+	if oauthErr.Description != "Refresh token revoked" || oauthErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected error details: %+v", oauthErr)
+	}
+	if oauthErr.Retryable() {
+		t.Error("Expected invalid_grant not to be retryable")
+	}
+}
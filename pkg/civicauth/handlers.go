@@ -0,0 +1,519 @@
+package civicauth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultFlowTTL bounds how long a user may take between /login and /callback
+	defaultFlowTTL = 10 * time.Minute
+
+	// defaultMaxFlows bounds the pending flows kept by a MemoryFlowStore
+	defaultMaxFlows = 10000
+
+	defaultFlowCookieName    = "civicauth_flow"
+	defaultSessionCookieName = "civicauth_session"
+)
+
+// AuthFlow is the state of an authorization request kept between the login redirect
+// and the callback
+type AuthFlow struct {
+	State        string    `json:"state"`
+	Nonce        string    `json:"nonce"`
+	CodeVerifier string    `json:"code_verifier"`
+	ReturnTo     string    `json:"return_to,omitempty"`
+	Expiry       time.Time `json:"expiry"`
+
+	// RedirectURL is the redirect_uri of the authorization request, which the code
+	// exchange must repeat (default: Config.RedirectURL)
+	RedirectURL string `json:"redirect_uri,omitempty"`
+
+	// MaxAge and ACRValues are the max_age and acr_values of the authorization request,
+	// which the ID token must satisfy
+	MaxAge    int      `json:"max_age,omitempty"`
+	ACRValues []string `json:"acr_values,omitempty"`
+}
+
+// FlowStore keeps pending authorization flows, bound to the user's browser
+type FlowStore interface {
+	// Save stores flow for the browser making the request
+	Save(w http.ResponseWriter, r *http.Request, flow *AuthFlow) error
+
+	// Take returns the flow of the browser making the request and removes it, so
+	// that each flow completes at most once. It returns ErrFlowNotFound if there is none.
+	Take(w http.ResponseWriter, r *http.Request) (*AuthFlow, error)
+}
+
+// FlowStoreOptions configures the cookie identifying a browser's pending flow
+type FlowStoreOptions struct {
+	// CookieName is the name of the flow cookie (default: civicauth_flow)
+	CookieName string
+
+	// Secure restricts the cookie to HTTPS (default: true). Set it to false only to
+	// serve the application over plain HTTP during development.
+	Secure *bool
+
+	// Clock provides the current time for expiring abandoned flows (default: system clock)
+	Clock Clock
+
+	// MaxFlows is how many pending flows MemoryFlowStore keeps; when it is reached, the
+	// oldest flow is dropped (default: 10000)
+	MaxFlows int
+}
+
+// secure reports whether the flow cookie is restricted to HTTPS
+func (o *FlowStoreOptions) secure() bool {
+	return o.Secure == nil || *o.Secure
+}
+
+// MemoryFlowStore is an in-memory FlowStore that identifies flows with a random ID in
+// a short-lived cookie. Abandoned flows are dropped once they expire, or when the store
+// is full. It is safe for concurrent use but only works for a single server instance.
+type MemoryFlowStore struct {
+	opts  FlowStoreOptions
+	mu    sync.Mutex
+	flows map[string]*AuthFlow
+
+	// order holds flow IDs, oldest first; IDs of flows already taken are skipped
+	order []string
+}
+
+// NewMemoryFlowStore creates an in-memory flow store
+func NewMemoryFlowStore(opts *FlowStoreOptions) *MemoryFlowStore {
+	s := &MemoryFlowStore{flows: make(map[string]*AuthFlow)}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.CookieName == "" {
+		s.opts.CookieName = defaultFlowCookieName
+	}
+	if s.opts.Clock == nil {
+		s.opts.Clock = systemClock{}
+	}
+	if s.opts.MaxFlows <= 0 {
+		s.opts.MaxFlows = defaultMaxFlows
+	}
+	return s
+}
+
+// Save stores flow under a new random ID and sets the flow cookie
+func (s *MemoryFlowStore) Save(w http.ResponseWriter, r *http.Request, flow *AuthFlow) error {
+	id, err := generateSessionID()
+	if err != nil {
+		return fmt.Errorf("failed to generate flow ID: %w", err)
+	}
+
+	s.mu.Lock()
+	// Drop the oldest flows while they have expired or the store is full. Flows are
+	// saved in order of expiry, so this does not need to look at every flow.
+	now := s.opts.Clock.Now()
+	for len(s.order) > 0 {
+		oldest, ok := s.flows[s.order[0]]
+		if ok && len(s.order) < s.opts.MaxFlows && !now.After(oldest.Expiry) {
+			break
+		}
+		delete(s.flows, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.flows[id] = flow
+	s.order = append(s.order, id)
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.opts.CookieName,
+		Value:    id,
+		Path:     "/",
+		Expires:  flow.Expiry,
+		Secure:   s.opts.secure(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Take returns and removes the flow named by the flow cookie, and clears the cookie
+func (s *MemoryFlowStore) Take(w http.ResponseWriter, r *http.Request) (*AuthFlow, error) {
+	cookie, err := r.Cookie(s.opts.CookieName)
+	if err != nil {
+		return nil, ErrFlowNotFound
+	}
+	clearCookie(w, s.opts.CookieName, s.opts.secure())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flow, ok := s.flows[cookie.Value]
+	if !ok {
+		return nil, ErrFlowNotFound
+	}
+	delete(s.flows, cookie.Value)
+	return flow, nil
+}
+
+// LoginResult describes a completed login passed to AuthHandlerOptions.AfterLogin
+type LoginResult struct {
+	// Session is the new session, holding the tokens and the validated ID token
+	// claims. It is saved after AfterLogin returns.
+	Session *Session
+
+	// ReturnTo is the local path the user is redirected to. AfterLogin may change it;
+	// values that are not local paths are ignored.
+	ReturnTo string
+}
+
+// AuthHandlerOptions configures AuthHandler
+type AuthHandlerOptions struct {
+	// TokenManager validates ID tokens (default: a new token manager for the client)
+	TokenManager *TokenManager
+
+	// FlowStore keeps pending authorization flows (default: a MemoryFlowStore)
+	FlowStore FlowStore
+
+	// FlowTTL bounds how long a user may take to sign in (default: 10 minutes)
+	FlowTTL time.Duration
+
+	// AuthCodeURLOptions adds prompt, max_age, login_hint and acr_values to the
+	// authorization request (optional)
+	AuthCodeURLOptions *AuthCodeURLOptions
+
+	// Secure restricts the cookies of the default flow and session stores to HTTPS
+	// (default: true when Config.RedirectURL uses https)
+	Secure *bool
+
+	// DefaultReturnTo is where users go after login when no return_to was requested,
+	// and after logout when there is no provider logout URL (default: /)
+	DefaultReturnTo string
+
+	// PostLogoutRedirectURL is sent to the provider's end session endpoint (optional)
+	PostLogoutRedirectURL string
+
+	// AfterLogin is called before the new session is saved, for example to provision
+	// the user or record an audit event. Returning an error discards the session and
+	// fails the login with 403 Forbidden. It must not write to w.
+	AfterLogin func(w http.ResponseWriter, r *http.Request, login *LoginResult) error
+
+	// OnError renders a failed login (default: a plain error response without details)
+	OnError func(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// AuthHandler provides the login, callback and logout endpoints of a web application.
+// Mount it under a prefix with http.StripPrefix, or use its Login, Callback and Logout
+// handlers directly. Config.RedirectURL must point to the callback endpoint.
+type AuthHandler struct {
+	client   *Client
+	sessions SessionStore
+	opts     AuthHandlerOptions
+
+	// defaultSessions is the session store created when none was given, closed by Close
+	defaultSessions *MemorySessionStore
+
+	mu        sync.Mutex
+	refreshes map[string]*sessionRefresh
+}
+
+// sessionRefresh is an in-flight token refresh shared by the concurrent requests of a
+// session, so that a rotated refresh token is only used once
+type sessionRefresh struct {
+	*call
+	tokens   *TokenResponse
+	issuedAt time.Time
+}
+
+// NewAuthHandler creates login, callback and logout handlers for client, keeping the
+// sessions started by a login in sessions (default: a MemorySessionStore, which must
+// be stopped with Close)
+func NewAuthHandler(client *Client, sessions SessionStore, opts *AuthHandlerOptions) *AuthHandler {
+	h := &AuthHandler{
+		client:    client,
+		sessions:  sessions,
+		refreshes: make(map[string]*sessionRefresh),
+	}
+	if opts != nil {
+		h.opts = *opts
+	}
+
+	secure := strings.HasPrefix(client.config.RedirectURL, "https://")
+	if h.opts.Secure != nil {
+		secure = *h.opts.Secure
+	}
+	if h.sessions == nil {
+		h.defaultSessions = NewMemorySessionStore(&SessionOptions{Secure: &secure, Clock: client.config.Clock})
+		h.sessions = h.defaultSessions
+	}
+
+	if h.opts.TokenManager == nil {
+		h.opts.TokenManager = NewTokenManager(client)
+	}
+	if h.opts.FlowStore == nil {
+		h.opts.FlowStore = NewMemoryFlowStore(&FlowStoreOptions{Secure: &secure, Clock: client.config.Clock})
+	}
+	if h.opts.FlowTTL == 0 {
+		h.opts.FlowTTL = defaultFlowTTL
+	}
+	if h.opts.DefaultReturnTo == "" {
+		h.opts.DefaultReturnTo = "/"
+	}
+	return h
+}
+
+// Close stops the background removal of expired sessions by the session store that
+// NewAuthHandler created when none was given. A session store passed to NewAuthHandler
+// is left for the caller to close.
+func (h *AuthHandler) Close() error {
+	if h.defaultSessions != nil {
+		return h.defaultSessions.Close()
+	}
+	return nil
+}
+
+// ServeHTTP routes /login, /callback and /logout
+func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/login":
+		h.Login(w, r)
+	case "/callback":
+		h.Callback(w, r)
+	case "/logout":
+		h.Logout(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Login starts an authorization request and redirects to the provider. A local path
+// in the return_to query parameter is restored after the callback.
+func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	flowOpts := &AuthCodeURLOptions{}
+	if h.opts.AuthCodeURLOptions != nil {
+		*flowOpts = *h.opts.AuthCodeURLOptions
+	}
+
+	authURL, state, nonce, codeVerifier, err := h.client.CreateAuthorizationFlowWithOptions(flowOpts)
+	if err != nil {
+		h.fail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	flow := &AuthFlow{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		ReturnTo:     h.returnTo(r.URL.Query().Get("return_to")),
+		Expiry:       h.client.config.Clock.Now().Add(h.opts.FlowTTL),
+		RedirectURL:  flowOpts.RedirectURL,
+		MaxAge:       flowOpts.MaxAge,
+		ACRValues:    flowOpts.ACRValues,
+	}
+	if err := h.opts.FlowStore.Save(w, r, flow); err != nil {
+		h.fail(w, r, http.StatusInternalServerError, fmt.Errorf("failed to save authorization flow: %w", err))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Callback completes the authorization request: it checks the state, exchanges the
+// code, validates the ID token and its nonce, and starts a new session
+func (h *AuthHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	flow, err := h.opts.FlowStore.Take(w, r)
+	if err != nil {
+		h.fail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if !h.client.config.Clock.Now().Before(flow.Expiry) {
+		h.fail(w, r, http.StatusBadRequest, fmt.Errorf("authorization flow expired"))
+		return
+	}
+
+	result, err := h.client.handleAuthorizationCallback(r.Context(), r, flow, h.opts.TokenManager)
+	if err != nil {
+		h.fail(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// Always start a new session so a session ID planted before login is never reused
+	if err := h.sessions.Delete(w, r); err != nil {
+		h.fail(w, r, http.StatusInternalServerError, fmt.Errorf("failed to end previous session: %w", err))
+		return
+	}
+
+	sessionID, err := generateSessionID()
+	if err != nil {
+		h.fail(w, r, http.StatusInternalServerError, fmt.Errorf("failed to generate session ID: %w", err))
+		return
+	}
+
+	login := &LoginResult{
+		Session: &Session{
+			ID:             sessionID,
+			Subject:        result.Claims.Subject,
+			Tokens:         result.Tokens,
+			TokensIssuedAt: h.client.config.Clock.Now(),
+			Claims:         result.Claims,
+		},
+		ReturnTo: flow.ReturnTo,
+	}
+	if h.opts.AfterLogin != nil {
+		if err := h.opts.AfterLogin(w, r, login); err != nil {
+			h.fail(w, r, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	if err := h.sessions.Save(w, r, login.Session); err != nil {
+		h.fail(w, r, http.StatusInternalServerError, fmt.Errorf("failed to save session: %w", err))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, h.returnTo(login.ReturnTo), http.StatusFound)
+}
+
+// Logout ends the session, revoking its tokens, and redirects to the provider's end
+// session endpoint when it has one. The session is ended even if revocation fails,
+// so the user is always signed out of the application.
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	logoutURL := h.opts.DefaultReturnTo
+	if session, err := h.sessions.Load(w, r); err == nil {
+		if session.Tokens != nil {
+			h.client.revokeTokens(r.Context(), session.Tokens)
+			if u, err := h.client.GetLogoutURL(h.opts.PostLogoutRedirectURL, session.Tokens.IDToken); err == nil {
+				logoutURL = u
+			}
+		}
+	}
+	h.sessions.Delete(w, r)
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, logoutURL, http.StatusFound)
+}
+
+// Session returns the session of the request, or ErrSessionNotFound if the user is not
+// signed in. Expired access tokens are refreshed, and the session saved, when the
+// session has a refresh token. Concurrent requests of a session share one refresh.
+func (h *AuthHandler) Session(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	session, err := h.sessions.Load(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := session.Tokens
+	if tokens == nil || tokens.RefreshToken == "" || !isTokenExpiredAt(tokens, session.TokensIssuedAt, h.client.config.Clock.Now()) {
+		return session, nil
+	}
+
+	refresh := h.refresh(r.Context(), session.ID, tokens)
+	if err := refresh.wait(r.Context()); err != nil {
+		// A request that loaded the session just before it was refreshed and saved
+		// finds the refreshed tokens in the store
+		if reloaded, loadErr := h.sessions.Load(w, r); loadErr == nil && reloaded.TokensIssuedAt.After(session.TokensIssuedAt) {
+			return reloaded, nil
+		}
+		return nil, fmt.Errorf("failed to refresh session tokens: %w", err)
+	}
+	session.Tokens = refresh.tokens
+	session.TokensIssuedAt = refresh.issuedAt
+
+	if err := h.sessions.Save(w, r, session); err != nil {
+		return nil, fmt.Errorf("failed to save session: %w", err)
+	}
+	return session, nil
+}
+
+// refresh returns the in-flight refresh of the session's tokens, starting one if there
+// is none
+func (h *AuthHandler) refresh(ctx context.Context, sessionID string, tokens *TokenResponse) *sessionRefresh {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if refresh := h.refreshes[sessionID]; refresh != nil {
+		return refresh
+	}
+
+	refresh := &sessionRefresh{}
+	refresh.call = startCall(ctx, func(ctx context.Context) error {
+		defer func() {
+			h.mu.Lock()
+			delete(h.refreshes, sessionID)
+			h.mu.Unlock()
+		}()
+
+		refreshed, err := h.client.RefreshToken(ctx, tokens.RefreshToken)
+		if err != nil {
+			return err
+		}
+		if refreshed.RefreshToken == "" {
+			refreshed.RefreshToken = tokens.RefreshToken
+		}
+		if refreshed.IDToken == "" {
+			refreshed.IDToken = tokens.IDToken
+		}
+		refresh.tokens = refreshed
+		refresh.issuedAt = h.client.config.Clock.Now()
+		return nil
+	})
+	h.refreshes[sessionID] = refresh
+	return refresh
+}
+
+// returnTo returns target if it is a local path, and the default otherwise, so that
+// return_to cannot be used to redirect users to another site
+func (h *AuthHandler) returnTo(target string) string {
+	if isLocalPath(target) {
+		return target
+	}
+	return h.opts.DefaultReturnTo
+}
+
+// fail reports a failed request through OnError, or with a plain error response
+func (h *AuthHandler) fail(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if h.opts.OnError != nil {
+		h.opts.OnError(w, r, status, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, http.StatusText(status), status)
+}
+
+// isLocalPath reports whether target is an absolute path on the same site. Browsers
+// treat "//host" and "/\host" as links to another host, and ignore tabs and newlines.
+func isLocalPath(target string) bool {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return false
+	}
+	if strings.ContainsAny(target, "\\\t\r\n") {
+		return false
+	}
+	u, err := url.Parse(target)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
+
+// clearCookie expires the named cookie
+func clearCookie(w http.ResponseWriter, name string, secure bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// generateSessionID generates a random 256-bit identifier
+func generateSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,508 @@
+package civicauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serve sends a request with the given cookies to h and records the response
+func serve(h http.Handler, target string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// responseCookie returns the named cookie set by a response; like browsers, the last
+// one set wins
+func responseCookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	var found *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == name {
+			found = cookie
+		}
+	}
+	return found
+}
+
+// webProvider returns a test provider whose token endpoint issues an ID token with
+// the nonce of the last authorization request started by login, and refreshes tokens
+func webProvider(t *testing.T) (*testProvider, *string) {
+	provider := newTestProvider(t)
+	nonce := new(string)
+	provider.handlers["/token"] = func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("grant_type") == "refresh_token" {
+			writeJSON(w, &TokenResponse{AccessToken: "refreshed-access-token", TokenType: "Bearer", ExpiresIn: 3600})
+			return
+		}
+		if r.PostFormValue("code") != "auth-code" || r.PostFormValue("code_verifier") == "" {
+			t.Errorf("Expected code and code verifier in token request, got %v", r.PostForm)
+		}
+		claims := provider.idTokenClaims()
+		claims["nonce"] = *nonce
+		writeJSON(w, &TokenResponse{
+			AccessToken:  "access-token",
+			RefreshToken: "refresh-token",
+			IDToken:      provider.signToken(t, claims),
+			TokenType:    "Bearer",
+			ExpiresIn:    3600,
+		})
+	}
+	return provider, nonce
+}
+
+// login starts a login on h and returns the authorization request parameters and the
+// cookies set by the login response
+func login(t *testing.T, h http.Handler, target string, nonce *string) (url.Values, []*http.Cookie) {
+	t.Helper()
+
+	rec := serve(h, target, nil)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected login redirect, got status %d", rec.Code)
+	}
+	authURL, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Failed to parse authorization URL: %v", err)
+	}
+	query := authURL.Query()
+	*nonce = query.Get("nonce")
+	return query, rec.Result().Cookies()
+}
+
+// loadSession loads the session named by cookie from sessions
+func loadSession(sessions SessionStore, cookie *http.Cookie) (*Session, error) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	return sessions.Load(httptest.NewRecorder(), r)
+}
+
+// newTestSessionStore creates a memory session store that is closed with the test
+func newTestSessionStore(t *testing.T, opts *SessionOptions) *MemorySessionStore {
+	sessions := NewMemorySessionStore(opts)
+	t.Cleanup(func() { sessions.Close() })
+	return sessions
+}
+
+func TestAuthHandlerLogin(t *testing.T) {
+	provider, nonce := webProvider(t)
+	sessions := newTestSessionStore(t, nil)
+
+	var afterLogin *LoginResult
+	h := NewAuthHandler(provider.newClient(t, nil), sessions, &AuthHandlerOptions{
+		AfterLogin: func(w http.ResponseWriter, r *http.Request, login *LoginResult) error {
+			afterLogin = login
+			return nil
+		},
+	})
+
+	authQuery, cookies := login(t, h, "/login?return_to=%2Forders%3Fpage%3D2", nonce)
+	if authQuery.Get("code_challenge") == "" || authQuery.Get("state") == "" {
+		t.Errorf("Expected PKCE and state in authorization request, got %v", authQuery)
+	}
+
+	rec := serve(h, "/callback?code=auth-code&state="+authQuery.Get("state"), cookies)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/orders?page=2" {
+		t.Fatalf("Expected redirect to /orders?page=2, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	session := responseCookie(rec, "civicauth_session")
+	if session == nil || !session.HttpOnly || session.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("Expected HttpOnly SameSite=Lax session cookie, got %+v", session)
+	}
+	stored, err := loadSession(sessions, session)
+	if err != nil {
+		t.Fatalf("Failed to load session: %v", err)
+	}
+	if stored.Subject != "user123" || stored.Tokens.AccessToken != "access-token" || stored.Claims.Subject != "user123" {
+		t.Errorf("Expected tokens and claims in the session, got %+v", stored)
+	}
+	if afterLogin == nil || afterLogin.Session.ID != session.Value {
+		t.Errorf("Expected AfterLogin to receive the session, got %+v", afterLogin)
+	}
+
+	// The flow cannot be completed twice
+	if rec := serve(h, "/callback?code=auth-code&state="+authQuery.Get("state"), cookies); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected replayed callback to be rejected, got status %d", rec.Code)
+	}
+
+	// Logging in again replaces the existing session
+	authQuery, cookies = login(t, h, "/login", nonce)
+	rec = serve(h, "/callback?code=auth-code&state="+authQuery.Get("state"), append(cookies, session))
+	if next := responseCookie(rec, "civicauth_session"); next == nil || next.Value == session.Value {
+		t.Fatalf("Expected a new session ID, got %+v", next)
+	}
+	if _, err := loadSession(sessions, session); err == nil {
+		t.Error("Expected the previous session to be deleted")
+	}
+	if rec.Header().Get("Location") != "/" {
+		t.Errorf("Expected redirect to /, got %s", rec.Header().Get("Location"))
+	}
+}
+
+func TestAuthHandlerRedirectURL(t *testing.T) {
+	provider, nonce := webProvider(t)
+	issue := provider.handlers["/token"]
+	var redirectURI string
+	provider.handlers["/token"] = func(w http.ResponseWriter, r *http.Request) {
+		redirectURI = r.PostFormValue("redirect_uri")
+		issue(w, r)
+	}
+
+	h := NewAuthHandler(provider.newClient(t, nil), newTestSessionStore(t, nil), &AuthHandlerOptions{
+		AuthCodeURLOptions: &AuthCodeURLOptions{RedirectURL: "https://app.example.com/auth/callback"},
+	})
+
+	authQuery, cookies := login(t, h, "/login", nonce)
+	if authQuery.Get("redirect_uri") != "https://app.example.com/auth/callback" {
+		t.Errorf("Expected the configured redirect_uri in the authorization request, got %s", authQuery.Get("redirect_uri"))
+	}
+	rec := serve(h, "/callback?code=auth-code&state="+authQuery.Get("state"), cookies)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected login to complete, got status %d", rec.Code)
+	}
+	if redirectURI != "https://app.example.com/auth/callback" {
+		t.Errorf("Expected the code exchange to repeat the redirect_uri of the authorization request, got %s", redirectURI)
+	}
+}
+
+func TestAuthHandlerCallbackErrors(t *testing.T) {
+	provider, nonce := webProvider(t)
+	clock := &fixedClock{now: time.Now()}
+	client := provider.newClient(t, func(c *Config) {
+		c.Clock = clock
+	})
+
+	tests := []struct {
+		name           string
+		opts           *AuthHandlerOptions
+		callback       func(authQuery url.Values) string
+		withoutCookies bool
+		modify         func()
+		expectedStatus int
+	}{
+		{
+			name:           "state mismatch",
+			callback:       func(url.Values) string { return "code=auth-code&state=forged" },
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "missing flow cookie",
+			callback:       func(q url.Values) string { return "code=auth-code&state=" + q.Get("state") },
+			withoutCookies: true,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "provider error",
+			callback:       func(q url.Values) string { return "error=access_denied&state=" + q.Get("state") },
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "nonce mismatch",
+			callback:       func(q url.Values) string { return "code=auth-code&state=" + q.Get("state") },
+			modify:         func() { *nonce = "other-nonce" },
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "rejected by AfterLogin",
+			opts: &AuthHandlerOptions{
+				AfterLogin: func(w http.ResponseWriter, r *http.Request, login *LoginResult) error {
+					return fmt.Errorf("user is not allowed")
+				},
+			},
+			callback:       func(q url.Values) string { return "code=auth-code&state=" + q.Get("state") },
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "acr_values not satisfied",
+			opts:           &AuthHandlerOptions{AuthCodeURLOptions: &AuthCodeURLOptions{ACRValues: []string{"urn:high"}}},
+			callback:       func(q url.Values) string { return "code=auth-code&state=" + q.Get("state") },
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "max_age without auth_time",
+			opts:           &AuthHandlerOptions{AuthCodeURLOptions: &AuthCodeURLOptions{MaxAge: 60}},
+			callback:       func(q url.Values) string { return "code=auth-code&state=" + q.Get("state") },
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "expired flow",
+			callback:       func(q url.Values) string { return "code=auth-code&state=" + q.Get("state") },
+			modify:         func() { clock.now = clock.now.Add(time.Hour) },
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := newTestSessionStore(t, nil)
+			h := NewAuthHandler(client, sessions, tt.opts)
+
+			authQuery, cookies := login(t, h, "/login", nonce)
+			if tt.withoutCookies {
+				cookies = nil
+			}
+			if tt.modify != nil {
+				tt.modify()
+			}
+
+			rec := serve(h, "/callback?"+tt.callback(authQuery), cookies)
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, rec.Code)
+			}
+			if cookie := responseCookie(rec, "civicauth_session"); cookie != nil && cookie.MaxAge >= 0 {
+				t.Errorf("Expected no session cookie, got %+v", cookie)
+			}
+			if len(sessions.sessions) != 0 {
+				t.Errorf("Expected no sessions, got %d", len(sessions.sessions))
+			}
+		})
+	}
+}
+
+func TestAuthHandlerLogout(t *testing.T) {
+	provider, nonce := webProvider(t)
+	sessions := newTestSessionStore(t, nil)
+	h := NewAuthHandler(provider.newClient(t, nil), sessions, &AuthHandlerOptions{
+		PostLogoutRedirectURL: "http://localhost:8080/",
+	})
+
+	authQuery, cookies := login(t, h, "/login", nonce)
+	session := responseCookie(serve(h, "/callback?code=auth-code&state="+authQuery.Get("state"), cookies), "civicauth_session")
+
+	rec := serve(h, "/logout", []*http.Cookie{session})
+	logoutURL, _ := url.Parse(rec.Header().Get("Location"))
+	if logoutURL == nil || logoutURL.Path != "/logout" || logoutURL.Query().Get("id_token_hint") == "" {
+		t.Errorf("Expected redirect to the end session endpoint with id_token_hint, got %s", rec.Header().Get("Location"))
+	}
+	if cookie := responseCookie(rec, "civicauth_session"); cookie == nil || cookie.MaxAge >= 0 {
+		t.Errorf("Expected session cookie to be cleared, got %+v", cookie)
+	}
+	if _, err := loadSession(sessions, session); err == nil {
+		t.Error("Expected the session to be deleted")
+	}
+
+	// Without a session there is nothing to end at the provider
+	if rec := serve(h, "/logout", nil); rec.Header().Get("Location") != "/" {
+		t.Errorf("Expected redirect to /, got %s", rec.Header().Get("Location"))
+	}
+}
+
+func TestAuthHandlerSessionRefresh(t *testing.T) {
+	provider, nonce := webProvider(t)
+	clock := &fixedClock{now: time.Now()}
+	h := NewAuthHandler(provider.newClient(t, func(c *Config) {
+		c.Clock = clock
+	}), nil, nil)
+
+	authQuery, cookies := login(t, h, "/login", nonce)
+	session := responseCookie(serve(h, "/callback?code=auth-code&state="+authQuery.Get("state"), cookies), "civicauth_session")
+
+	current := func() *Session {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/profile", nil)
+		r.AddCookie(session)
+		loaded, err := h.Session(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatalf("Failed to get session: %v", err)
+		}
+		return loaded
+	}
+
+	if tokens := current().Tokens; tokens.AccessToken != "access-token" {
+		t.Errorf("Expected the login access token, got %s", tokens.AccessToken)
+	}
+
+	// Keep the session active until the access token's expires_in has passed
+	var tokens *TokenResponse
+	for i := 0; i < 3; i++ {
+		clock.now = clock.now.Add(25 * time.Minute)
+		tokens = current().Tokens
+	}
+	if tokens.AccessToken != "refreshed-access-token" || tokens.RefreshToken != "refresh-token" || tokens.IDToken == "" {
+		t.Errorf("Expected refreshed tokens keeping the refresh and ID tokens, got %+v", tokens)
+	}
+
+	r := httptest.NewRequest("GET", "/profile", nil)
+	if _, err := h.Session(httptest.NewRecorder(), r); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected ErrSessionNotFound without a session cookie, got: %v", err)
+	}
+}
+
+func TestAuthHandlerSessionConcurrentRefresh(t *testing.T) {
+	provider, nonce := webProvider(t)
+	issue := provider.handlers["/token"]
+	var refreshes int32
+	var used atomic.Bool
+	release := make(chan struct{})
+	provider.handlers["/token"] = func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("grant_type") != "refresh_token" {
+			issue(w, r)
+			return
+		}
+		atomic.AddInt32(&refreshes, 1)
+		<-release
+		// The provider rotates refresh tokens, so each can only be used once
+		if r.PostFormValue("refresh_token") != "refresh-token" || !used.CompareAndSwap(false, true) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		writeJSON(w, &TokenResponse{AccessToken: "refreshed-access-token", RefreshToken: "rotated-refresh-token", TokenType: "Bearer", ExpiresIn: 3600})
+	}
+
+	clock := &fixedClock{now: time.Now()}
+	h := NewAuthHandler(provider.newClient(t, func(c *Config) {
+		c.Clock = clock
+	}), newTestSessionStore(t, &SessionOptions{IdleTimeout: 3 * time.Hour, Clock: clock}), nil)
+
+	authQuery, cookies := login(t, h, "/login", nonce)
+	session := responseCookie(serve(h, "/callback?code=auth-code&state="+authQuery.Get("state"), cookies), "civicauth_session")
+	clock.now = clock.now.Add(2 * time.Hour)
+
+	// Requests made at once after the access token expired share one refresh
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/profile", nil)
+			r.AddCookie(session)
+			loaded, err := h.Session(httptest.NewRecorder(), r)
+			if err != nil {
+				t.Errorf("Failed to get session: %v", err)
+				return
+			}
+			if loaded.Tokens.RefreshToken != "rotated-refresh-token" {
+				t.Errorf("Expected the rotated refresh token, got %s", loaded.Tokens.RefreshToken)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&refreshes); n != 1 {
+		t.Errorf("Expected 1 refresh request for concurrent requests, got %d", n)
+	}
+}
+
+func TestAuthHandlerClose(t *testing.T) {
+	provider := newTestProvider(t)
+	client := provider.newClient(t, nil)
+
+	h := NewAuthHandler(client, nil, nil)
+	if h.defaultSessions == nil {
+		t.Fatal("Expected a default memory session store")
+	}
+	h.Close()
+	h.Close()
+	select {
+	case <-h.defaultSessions.done:
+	default:
+		t.Error("Expected Close to stop the default session store")
+	}
+
+	// Stores passed in are left for the caller to close
+	sessions := newTestSessionStore(t, nil)
+	NewAuthHandler(client, sessions, nil).Close()
+	select {
+	case <-sessions.done:
+		t.Error("Expected the given session store to stay open")
+	default:
+	}
+}
+
+func TestMemoryFlowStore(t *testing.T) {
+	clock := &fixedClock{now: time.Now().Add(-24 * time.Hour)}
+	flows := NewMemoryFlowStore(&FlowStoreOptions{Clock: clock})
+
+	save := func() *http.Cookie {
+		rec := httptest.NewRecorder()
+		flow := &AuthFlow{State: "state", Expiry: clock.now.Add(defaultFlowTTL)}
+		if err := flows.Save(rec, httptest.NewRequest("GET", "/login", nil), flow); err != nil {
+			t.Fatalf("Failed to save flow: %v", err)
+		}
+		return responseCookie(rec, "civicauth_flow")
+	}
+
+	// Abandoned flows are expired with the store's clock, not the system clock
+	first := save()
+	save()
+	if len(flows.flows) != 2 {
+		t.Fatalf("Expected 2 pending flows, got %d", len(flows.flows))
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	latest := save()
+	if len(flows.flows) != 1 {
+		t.Errorf("Expected abandoned flows to be dropped, got %d", len(flows.flows))
+	}
+
+	take := func(cookie *http.Cookie) error {
+		r := httptest.NewRequest("GET", "/callback", nil)
+		r.AddCookie(cookie)
+		_, err := flows.Take(httptest.NewRecorder(), r)
+		return err
+	}
+	if err := take(first); !errors.Is(err, ErrFlowNotFound) {
+		t.Errorf("Expected ErrFlowNotFound for a dropped flow, got: %v", err)
+	}
+	if err := take(latest); err != nil {
+		t.Errorf("Failed to take flow: %v", err)
+	}
+	if err := take(latest); !errors.Is(err, ErrFlowNotFound) {
+		t.Errorf("Expected a flow to be taken only once, got: %v", err)
+	}
+
+	// A flood of logins cannot grow the store beyond MaxFlows
+	flows = NewMemoryFlowStore(&FlowStoreOptions{Clock: clock, MaxFlows: 3})
+	oldest := save()
+	for i := 0; i < 10; i++ {
+		latest = save()
+	}
+	if len(flows.flows) != 3 || len(flows.order) != 3 {
+		t.Errorf("Expected at most 3 pending flows, got %d", len(flows.flows))
+	}
+	if err := take(oldest); !errors.Is(err, ErrFlowNotFound) {
+		t.Errorf("Expected the oldest flow to be dropped, got: %v", err)
+	}
+	if err := take(latest); err != nil {
+		t.Errorf("Failed to take the latest flow: %v", err)
+	}
+}
+
+func TestIsLocalPath(t *testing.T) {
+	tests := []struct {
+		target   string
+		expected bool
+	}{
+		{"/", true},
+		{"/orders?page=2#top", true},
+		{"", false},
+		{"orders", false},
+		{"https://evil.example.com/", false},
+		{"//evil.example.com/", false},
+		{"/\\evil.example.com/", false},
+		{"/\t/evil.example.com/", false},
+		{"/orders\\..\\", false},
+		{"javascript:alert(1)", false},
+	}
+
+	for _, tt := range tests {
+		if got := isLocalPath(tt.target); got != tt.expected {
+			t.Errorf("isLocalPath(%q) = %v, expected %v", tt.target, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package civicauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultIntrospectionCacheTTL is how long active introspection results are cached
+	defaultIntrospectionCacheTTL = time.Minute
+
+	// defaultIntrospectionNegativeCacheTTL is how long inactive results are cached
+	defaultIntrospectionNegativeCacheTTL = 10 * time.Second
+
+	// defaultIntrospectionCacheSize bounds the number of cached introspection results
+	defaultIntrospectionCacheSize = 10000
+)
+
+// IntrospectionResponse is the provider's description of a token (RFC 7662 section 2.2)
+type IntrospectionResponse struct {
+	Active    bool      `json:"active"`
+	Scope     ScopeList `json:"scope,omitempty"`
+	ClientID  string    `json:"client_id,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	TokenType string    `json:"token_type,omitempty"`
+	Expiry    int64     `json:"exp,omitempty"`
+	IssuedAt  int64     `json:"iat,omitempty"`
+	NotBefore int64     `json:"nbf,omitempty"`
+	Subject   string    `json:"sub,omitempty"`
+	Audience  Audience  `json:"aud,omitempty"`
+	Issuer    string    `json:"iss,omitempty"`
+	JWTID     string    `json:"jti,omitempty"`
+
+	// Extra holds every member of the response, including provider-specific ones
+	Extra map[string]interface{} `json:"-"`
+}
+
+// IntrospectToken asks the provider's introspection endpoint whether a token is
+// active (RFC 7662), authenticating with the client's configured credentials. An
+// inactive token is not an error: check IntrospectionResponse.Active.
+func (c *Client) IntrospectToken(ctx context.Context, token, tokenTypeHint string) (*IntrospectionResponse, error) {
+	if c.provider == nil {
+		return nil, ErrProviderNotInitialized
+	}
+	if c.provider.IntrospectionEndpoint == "" {
+		return nil, fmt.Errorf("introspection endpoint not available")
+	}
+
+	data := url.Values{
+		"token": []string{token},
+	}
+	if tokenTypeHint != "" {
+		data.Set("token_type_hint", tokenTypeHint)
+	}
+
+	resp, body, err := c.postForm(ctx, c.provider.IntrospectionEndpoint, data)
+	if err != nil {
+		return nil, fmt.Errorf("token introspection failed: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token introspection failed: %w", parseErrorResponse(resp, body))
+	}
+
+	var introspection IntrospectionResponse
+	if err := json.Unmarshal(body, &introspection); err != nil {
+		return nil, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+	if err := json.Unmarshal(body, &introspection.Extra); err != nil {
+		return nil, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+
+	return &introspection, nil
+}
+
+// IntrospectionOptions configures the caching of an Introspector
+type IntrospectionOptions struct {
+	// CacheTTL is how long an active result is cached, never beyond the token's exp
+	// (default: 1 minute; negative disables caching of active results)
+	CacheTTL time.Duration
+
+	// NegativeCacheTTL is how long an inactive result is cached (default: 10 seconds;
+	// negative disables caching of inactive results)
+	NegativeCacheTTL time.Duration
+
+	// MaxEntries bounds the number of cached results (default: 10000)
+	MaxEntries int
+}
+
+// Introspector introspects tokens for a resource server, caching the results so that
+// repeated requests with the same token do not each call the provider. It is safe for
+// concurrent use. Tokens are cached by their SHA-256 hash, never in the clear.
+type Introspector struct {
+	Client *Client
+
+	opts  IntrospectionOptions
+	mu    sync.Mutex
+	cache map[string]*introspectionEntry
+}
+
+// introspectionEntry is a cached introspection result
+type introspectionEntry struct {
+	response *IntrospectionResponse
+	expiry   time.Time
+}
+
+// NewIntrospector creates an introspector for the client with optional cache settings
+func NewIntrospector(client *Client, opts *IntrospectionOptions) *Introspector {
+	i := &Introspector{
+		Client: client,
+		cache:  make(map[string]*introspectionEntry),
+	}
+	if opts != nil {
+		i.opts = *opts
+	}
+	if i.opts.CacheTTL == 0 {
+		i.opts.CacheTTL = defaultIntrospectionCacheTTL
+	}
+	if i.opts.NegativeCacheTTL == 0 {
+		i.opts.NegativeCacheTTL = defaultIntrospectionNegativeCacheTTL
+	}
+	if i.opts.MaxEntries <= 0 {
+		i.opts.MaxEntries = defaultIntrospectionCacheSize
+	}
+	return i
+}
+
+// Introspect returns the introspection result for token, from the cache if possible
+func (i *Introspector) Introspect(ctx context.Context, token string) (*IntrospectionResponse, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	now := i.Client.config.Clock.Now()
+
+	i.mu.Lock()
+	if entry, ok := i.cache[key]; ok {
+		if now.Before(entry.expiry) {
+			i.mu.Unlock()
+			return entry.response, nil
+		}
+		delete(i.cache, key)
+	}
+	i.mu.Unlock()
+
+	resp, err := i.Client.IntrospectToken(ctx, token, TokenTypeHintAccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if expiry, ok := i.cacheExpiry(resp, now); ok {
+		i.mu.Lock()
+		i.store(key, &introspectionEntry{response: resp, expiry: expiry}, now)
+		i.mu.Unlock()
+	}
+
+	return resp, nil
+}
+
+// cacheExpiry returns until when resp may be cached, and false if it must not be
+func (i *Introspector) cacheExpiry(resp *IntrospectionResponse, now time.Time) (time.Time, bool) {
+	if !resp.Active {
+		if i.opts.NegativeCacheTTL < 0 {
+			return time.Time{}, false
+		}
+		return now.Add(i.opts.NegativeCacheTTL), true
+	}
+
+	if i.opts.CacheTTL < 0 {
+		return time.Time{}, false
+	}
+	expiry := now.Add(i.opts.CacheTTL)
+	if resp.Expiry != 0 {
+		// An active result must not outlive the token itself
+		if tokenExpiry := time.Unix(resp.Expiry, 0); tokenExpiry.Before(expiry) {
+			expiry = tokenExpiry
+		}
+	}
+	return expiry, expiry.After(now)
+}
+
+// store adds an entry to the cache, evicting expired entries when it is full and
+// clearing it if that is not enough. The caller must hold i.mu.
+func (i *Introspector) store(key string, entry *introspectionEntry, now time.Time) {
+	if len(i.cache) >= i.opts.MaxEntries {
+		for k, e := range i.cache {
+			if !now.Before(e.expiry) {
+				delete(i.cache, k)
+			}
+		}
+		if len(i.cache) >= i.opts.MaxEntries {
+			i.cache = make(map[string]*introspectionEntry)
+		}
+	}
+	i.cache[key] = entry
+}
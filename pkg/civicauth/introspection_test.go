@@ -0,0 +1,135 @@
+package civicauth
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// introspectionProvider returns a test provider whose introspection endpoint answers
+// with the response registered for each token and counts the requests
+func introspectionProvider(t *testing.T, responses map[string]map[string]interface{}, requests *int32) *testProvider {
+	provider := newTestProvider(t)
+	provider.metadata["introspection_endpoint"] = provider.server.URL + "/introspect"
+	provider.handlers["/introspect"] = func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if _, _, ok := r.BasicAuth(); !ok {
+			t.Error("Expected the client to authenticate the introspection request")
+		}
+		if resp, ok := responses[r.PostFormValue("token")]; ok {
+			writeJSON(w, resp)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"active": false})
+	}
+	return provider
+}
+
+func TestIntrospectToken(t *testing.T) {
+	var requests int32
+	now := time.Now()
+	provider := introspectionProvider(t, map[string]map[string]interface{}{
+		"active-token": {
+			"active":    true,
+			"scope":     "orders:read orders:write",
+			"client_id": "orders-client",
+			"sub":       "user123",
+			"aud":       []string{"https://api.example.com", "https://billing.example.com"},
+			"exp":       now.Add(time.Hour).Unix(),
+			"tenant":    "acme",
+		},
+	}, &requests)
+
+	client := provider.newClient(t, nil)
+	resp, err := client.IntrospectToken(context.Background(), "active-token", TokenTypeHintAccessToken)
+	if err != nil {
+		t.Fatalf("Token introspection failed: %v", err)
+	}
+
+	if !resp.Active || resp.Subject != "user123" || resp.ClientID != "orders-client" {
+		t.Errorf("Unexpected introspection response: %+v", resp)
+	}
+	if !resp.Scope.Contains("orders:write") || len(resp.Scope) != 2 {
+		t.Errorf("Expected parsed scopes, got %v", resp.Scope)
+	}
+	if !resp.Audience.Contains("https://billing.example.com") {
+		t.Errorf("Expected audience array, got %v", resp.Audience)
+	}
+	if resp.Extra["tenant"] != "acme" {
+		t.Errorf("Expected extra member tenant, got %v", resp.Extra["tenant"])
+	}
+
+	inactive, err := client.IntrospectToken(context.Background(), "revoked-token", "")
+	if err != nil {
+		t.Fatalf("Token introspection failed: %v", err)
+	}
+	if inactive.Active {
+		t.Error("Expected inactive token")
+	}
+}
+
+func TestIntrospectorCache(t *testing.T) {
+	var requests int32
+	now := time.Now()
+	provider := introspectionProvider(t, map[string]map[string]interface{}{
+		"long-lived":  {"active": true, "exp": now.Add(time.Hour).Unix()},
+		"short-lived": {"active": true, "exp": now.Add(20 * time.Second).Unix()},
+	}, &requests)
+
+	clock := &fixedClock{now: now}
+	client := provider.newClient(t, func(c *Config) {
+		c.Clock = clock
+	})
+	introspector := NewIntrospector(client, &IntrospectionOptions{
+		CacheTTL:         time.Minute,
+		NegativeCacheTTL: 5 * time.Second,
+	})
+	ctx := context.Background()
+
+	introspect := func(token string, expectedRequests int32) {
+		t.Helper()
+		if _, err := introspector.Introspect(ctx, token); err != nil {
+			t.Fatalf("Introspection failed: %v", err)
+		}
+		if n := atomic.LoadInt32(&requests); n != expectedRequests {
+			t.Errorf("Expected %d introspection requests after %s, got %d", expectedRequests, token, n)
+		}
+	}
+
+	introspect("long-lived", 1)
+	introspect("long-lived", 1)
+	introspect("short-lived", 2)
+	introspect("unknown", 3)
+	introspect("unknown", 3)
+
+	// Inactive results expire after NegativeCacheTTL
+	clock.now = now.Add(10 * time.Second)
+	introspect("unknown", 4)
+
+	// Active results are never cached beyond the token's exp
+	clock.now = now.Add(30 * time.Second)
+	introspect("short-lived", 5)
+	introspect("long-lived", 5)
+
+	// And expire after CacheTTL
+	clock.now = now.Add(2 * time.Minute)
+	introspect("long-lived", 6)
+}
+
+func TestIntrospectorCacheDisabled(t *testing.T) {
+	var requests int32
+	provider := introspectionProvider(t, nil, &requests)
+
+	introspector := NewIntrospector(provider.newClient(t, nil), &IntrospectionOptions{NegativeCacheTTL: -1})
+	for i := 0; i < 2; i++ {
+		if _, err := introspector.Introspect(context.Background(), "unknown"); err != nil {
+			t.Fatalf("Introspection failed: %v", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected 2 introspection requests without negative caching, got %d", n)
+	}
+}
@@ -0,0 +1,405 @@
+package civicauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxJWKSCacheTTL caps how long a JWK set is cached regardless of the response headers
+const maxJWKSCacheTTL = 24 * time.Hour
+
+// JWK represents a JSON Web Key
+type JWK struct {
+	Kty string   `json:"kty"`
+	Use string   `json:"use"`
+	Alg string   `json:"alg,omitempty"`
+	Kid string   `json:"kid"`
+	X5t string   `json:"x5t"`
+	N   string   `json:"n"`
+	E   string   `json:"e"`
+	Crv string   `json:"crv,omitempty"`
+	X   string   `json:"x,omitempty"`
+	Y   string   `json:"y,omitempty"`
+	X5c []string `json:"x5c"`
+}
+
+// JWKSet represents a set of JSON Web Keys
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// jwksCache is a concurrency-safe cache of the provider's signing keys.
+// Keys are cached for the lifetime advertised by the JWKS response, concurrent
+// fetches are collapsed into a single request, and refreshes forced by unknown
+// key IDs or retried after a failed fetch are limited to one per
+// Config.JWKSMinRefreshInterval.
+type jwksCache struct {
+	client *Client
+
+	mu        sync.RWMutex
+	keys      map[string]*cachedKey
+	expiry    time.Time
+	lastFetch time.Time
+	lastErr   error
+	inflight  *call
+}
+
+// cachedKey is a verification key together with the JWK parameters that restrict its use
+type cachedKey struct {
+	key crypto.PublicKey
+	alg string
+	use string
+}
+
+// call tracks an in-flight operation shared by concurrent callers
+type call struct {
+	done chan struct{}
+	err  error
+}
+
+// startCall runs fn in the background for every caller waiting on the returned call.
+// fn keeps the values of ctx but not its cancellation, since its result is shared with
+// callers that are still waiting after the caller that started it gave up.
+func startCall(ctx context.Context, fn func(ctx context.Context) error) *call {
+	c := &call{done: make(chan struct{})}
+	go func() {
+		c.err = fn(context.WithoutCancel(ctx))
+		close(c.done)
+	}()
+	return c
+}
+
+// wait returns the error of the call once it completes, or the context's error if ctx
+// is done first
+func (c *call) wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newJWKSCache creates an empty key cache for the client's provider
+func newJWKSCache(client *Client) *jwksCache {
+	return &jwksCache{
+		client: client,
+		keys:   make(map[string]*cachedKey),
+	}
+}
+
+// getKey returns the key for the given key ID, fetching the JWK set when the cache
+// has expired or the key ID is unknown
+func (c *jwksCache) getKey(ctx context.Context, kid string) (*cachedKey, error) {
+	key, found, fresh := c.lookup(kid)
+	if found && fresh {
+		return key, nil
+	}
+
+	if !fresh {
+		if err := c.refresh(ctx, false); err != nil {
+			// Keep serving a stale key while the provider is unavailable
+			if found {
+				return key, nil
+			}
+			return nil, err
+		}
+	} else {
+		// The cache is fresh but the key is unknown; the provider may have rotated keys
+		if err := c.refresh(ctx, true); err != nil {
+			return nil, fmt.Errorf("failed to refetch JWK set: %w", err)
+		}
+	}
+
+	key, found, _ = c.lookup(kid)
+	if !found {
+		return nil, fmt.Errorf("key with kid %s not found", kid)
+	}
+
+	return key, nil
+}
+
+// lookup returns the cached key for kid and whether the cache is still fresh
+func (c *jwksCache) lookup(kid string) (key *cachedKey, found, fresh bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key, found = c.keys[kid]
+	return key, found, c.client.config.Clock.Now().Before(c.expiry)
+}
+
+// refresh fetches the JWK set, joining a fetch that is already in flight. A forced
+// refresh, or any refresh after a failed fetch, is skipped when the last fetch
+// happened less than the minimum refresh interval ago; the error of the last fetch
+// is returned instead. The caller stops waiting when ctx is done, while the fetch
+// continues for the other callers.
+func (c *jwksCache) refresh(ctx context.Context, force bool) error {
+	c.mu.Lock()
+	fetch := c.inflight
+	if fetch == nil {
+		if (force || c.lastErr != nil) && c.client.config.Clock.Now().Sub(c.lastFetch) < c.client.config.JWKSMinRefreshInterval {
+			err := c.lastErr
+			c.mu.Unlock()
+			return err
+		}
+
+		fetch = startCall(ctx, c.update)
+		c.inflight = fetch
+	}
+	c.mu.Unlock()
+
+	return fetch.wait(ctx)
+}
+
+// update fetches the JWK set and stores the result for the callers waiting on the fetch
+func (c *jwksCache) update(ctx context.Context) error {
+	keys, ttl, err := c.fetch(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.client.config.Clock.Now()
+	c.lastFetch = now
+	c.lastErr = err
+	if err == nil {
+		c.keys = keys
+		c.expiry = now.Add(ttl)
+	} else if len(c.keys) > 0 {
+		// Keep the previous keys and retry after the minimum refresh interval
+		c.expiry = now.Add(c.client.config.JWKSMinRefreshInterval)
+	}
+	c.inflight = nil
+	return err
+}
+
+// fetch downloads the JWK set and returns its keys and how long they may be cached
+func (c *jwksCache) fetch(ctx context.Context) (map[string]*cachedKey, time.Duration, error) {
+	if c.client.provider == nil {
+		return nil, 0, ErrProviderNotInitialized
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.client.provider.JwksURI, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create JWK request: %w", err)
+	}
+
+	resp, err := c.client.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch JWK set: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read JWK response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("JWK request failed: %w", parseErrorResponse(resp, body))
+	}
+
+	var jwkSet JWKSet
+	if err := json.Unmarshal(body, &jwkSet); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode JWK set: %w", err)
+	}
+
+	keys := make(map[string]*cachedKey, len(jwkSet.Keys))
+	for i := range jwkSet.Keys {
+		jwk := &jwkSet.Keys[i]
+		if jwk.Kid == "" {
+			continue
+		}
+
+		// Skip keys that cannot be used for verification rather than failing the whole set
+		publicKey, err := jwkToPublicKey(jwk)
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = &cachedKey{key: publicKey, alg: jwk.Alg, use: jwk.Use}
+	}
+
+	ttl := cacheTTL(resp.Header, c.client.config.Clock.Now(), c.client.config.JWKSCacheTTL)
+	if ttl < c.client.config.JWKSMinRefreshInterval {
+		ttl = c.client.config.JWKSMinRefreshInterval
+	}
+	if ttl > maxJWKSCacheTTL {
+		ttl = maxJWKSCacheTTL
+	}
+
+	return keys, ttl, nil
+}
+
+// cacheTTL derives a cache lifetime from the Cache-Control and Expires response
+// headers, falling back to defaultTTL when neither is present
+func cacheTTL(header http.Header, now time.Time, defaultTTL time.Duration) time.Duration {
+	if cacheControl := header.Get("Cache-Control"); cacheControl != "" {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+
+			switch {
+			case directive == "no-store" || directive == "no-cache":
+				return 0
+			case strings.HasPrefix(directive, "max-age="):
+				seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+				if err == nil && seconds >= 0 {
+					return time.Duration(seconds) * time.Second
+				}
+			}
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		expiry, err := http.ParseTime(expires)
+		if err != nil || !expiry.After(now) {
+			return 0
+		}
+		return expiry.Sub(now)
+	}
+
+	return defaultTTL
+}
+
+// jwkToPublicKey converts a JWK to an RSA, ECDSA or Ed25519 public key
+func jwkToPublicKey(jwk *JWK) (crypto.PublicKey, error) {
+	// Try X.509 certificate first
+	if len(jwk.X5c) > 0 {
+		certData, err := base64.StdEncoding.DecodeString(jwk.X5c[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode X.509 certificate: %w", err)
+		}
+
+		cert, err := x509.ParseCertificate(certData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse X.509 certificate: %w", err)
+		}
+
+		switch cert.PublicKey.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+			return cert.PublicKey, nil
+		default:
+			return nil, fmt.Errorf("certificate contains unsupported public key type %T", cert.PublicKey)
+		}
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		return jwkToRSAPublicKey(jwk)
+	case "EC":
+		return jwkToECDSAPublicKey(jwk)
+	case "OKP":
+		return jwkToEd25519PublicKey(jwk)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+// jwkToRSAPublicKey converts a JWK to an RSA public key
+func jwkToRSAPublicKey(jwk *JWK) (*rsa.PublicKey, error) {
+	if jwk.N == "" || jwk.E == "" {
+		return nil, fmt.Errorf("JWK missing required parameters")
+	}
+
+	nBytes, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode N parameter: %w", err)
+	}
+
+	eBytes, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode E parameter: %w", err)
+	}
+
+	// Convert bytes to big integers
+	n := new(rsa.PublicKey)
+	n.N = new(big.Int).SetBytes(nBytes)
+
+	// E is usually 65537, but decode from bytes to be safe
+	e := 0
+	for _, b := range eBytes {
+		e = e*256 + int(b)
+	}
+	n.E = e
+
+	return n, nil
+}
+
+// jwkToECDSAPublicKey converts an EC JWK on the P-256, P-384 or P-521 curve to an ECDSA public key
+func jwkToECDSAPublicKey(jwk *JWK) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	var ecdhCurve ecdh.Curve
+	switch jwk.Crv {
+	case "P-256":
+		curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+	case "P-384":
+		curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+	case "P-521":
+		curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+	default:
+		return nil, fmt.Errorf("unsupported EC curve %q", jwk.Crv)
+	}
+
+	if jwk.X == "" || jwk.Y == "" {
+		return nil, fmt.Errorf("JWK missing required parameters")
+	}
+
+	xBytes, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode X parameter: %w", err)
+	}
+
+	yBytes, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode Y parameter: %w", err)
+	}
+
+	size := (curve.Params().BitSize + 7) / 8
+	if len(xBytes) != size || len(yBytes) != size {
+		return nil, fmt.Errorf("invalid coordinate length for curve %s", jwk.Crv)
+	}
+
+	// Reject points that are not on the curve
+	point := append([]byte{4}, append(xBytes, yBytes...)...)
+	if _, err := ecdhCurve.NewPublicKey(point); err != nil {
+		return nil, fmt.Errorf("invalid EC public key: %w", err)
+	}
+
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(xBytes),
+		Y:     new(big.Int).SetBytes(yBytes),
+	}, nil
+}
+
+// jwkToEd25519PublicKey converts an OKP JWK on the Ed25519 curve to an Ed25519 public key
+func jwkToEd25519PublicKey(jwk *JWK) (ed25519.PublicKey, error) {
+	if jwk.Crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported OKP curve %q", jwk.Crv)
+	}
+
+	xBytes, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode X parameter: %w", err)
+	}
+
+	if len(xBytes) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 public key length %d", len(xBytes))
+	}
+
+	return ed25519.PublicKey(xBytes), nil
+}
@@ -0,0 +1,278 @@
+package civicauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected time.Duration
+	}{
+		{name: "no headers", header: http.Header{}, expected: time.Hour},
+		{name: "max-age", header: http.Header{"Cache-Control": {"public, max-age=600"}}, expected: 10 * time.Minute},
+		{name: "no-store", header: http.Header{"Cache-Control": {"no-store"}}, expected: 0},
+		{name: "expires", header: http.Header{"Expires": {now.Add(2 * time.Hour).UTC().Format(http.TimeFormat)}}, expected: 2 * time.Hour},
+		{name: "expires in the past", header: http.Header{"Expires": {now.Add(-time.Hour).UTC().Format(http.TimeFormat)}}, expected: 0},
+		{name: "max-age takes precedence", header: http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Expires":       {now.Add(2 * time.Hour).UTC().Format(http.TimeFormat)},
+		}, expected: time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl := cacheTTL(tt.header, now, time.Hour)
+
+			// Expires has one second resolution
+			if diff := ttl - tt.expected; diff < -time.Second || diff > time.Second {
+				t.Errorf("Expected TTL %v, got %v", tt.expected, ttl)
+			}
+		})
+	}
+}
+
+func TestJWKSCacheConcurrentFetches(t *testing.T) {
+	provider := newTestProvider(t)
+	tm := NewTokenManager(provider.newClient(t, nil))
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := tm.keys.getKey(ctx, provider.kid); err != nil {
+				t.Errorf("Failed to get key: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if requests := atomic.LoadInt32(&provider.jwksRequests); requests != 1 {
+		t.Errorf("Expected 1 JWKS request, got %d", requests)
+	}
+}
+
+func TestJWKSCacheUnknownKeyRateLimit(t *testing.T) {
+	provider := newTestProvider(t)
+	clock := &fixedClock{now: time.Now()}
+	tm := NewTokenManager(provider.newClient(t, func(c *Config) {
+		c.JWKSMinRefreshInterval = time.Minute
+		c.Clock = clock
+	}))
+	ctx := context.Background()
+
+	if _, err := tm.keys.getKey(ctx, provider.kid); err != nil {
+		t.Fatalf("Failed to get key: %v", err)
+	}
+
+	// Unknown key IDs must not trigger a fetch per request
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := tm.keys.getKey(ctx, "unknown-kid"); err == nil {
+				t.Error("Expected error for unknown key ID, got nil")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if requests := atomic.LoadInt32(&provider.jwksRequests); requests != 1 {
+		t.Errorf("Expected 1 JWKS request, got %d", requests)
+	}
+
+	// Once the interval has passed, an unknown key ID picks up rotated keys
+	clock.now = clock.now.Add(time.Minute)
+	provider.kid = "rotated-key"
+
+	if _, err := tm.keys.getKey(ctx, "rotated-key"); err != nil {
+		t.Fatalf("Expected rotated key to be found, got: %v", err)
+	}
+
+	if requests := atomic.LoadInt32(&provider.jwksRequests); requests != 2 {
+		t.Errorf("Expected 2 JWKS requests, got %d", requests)
+	}
+}
+
+func TestJWKSCacheHonorsCacheControl(t *testing.T) {
+	provider := newTestProvider(t)
+	provider.handlers["/jwks"] = func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&provider.jwksRequests, 1)
+		w.Header().Set("Cache-Control", "max-age=0")
+		writeJSON(w, provider.jwks())
+	}
+	clock := &fixedClock{now: time.Now()}
+	tm := NewTokenManager(provider.newClient(t, func(c *Config) {
+		c.JWKSMinRefreshInterval = time.Minute
+		c.Clock = clock
+	}))
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := tm.keys.getKey(ctx, provider.kid); err != nil {
+			t.Fatalf("Failed to get key: %v", err)
+		}
+	}
+
+	if requests := atomic.LoadInt32(&provider.jwksRequests); requests != 1 {
+		t.Errorf("Expected 1 JWKS request within the minimum interval, got %d", requests)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+
+	if _, err := tm.keys.getKey(ctx, provider.kid); err != nil {
+		t.Fatalf("Failed to get key: %v", err)
+	}
+
+	if requests := atomic.LoadInt32(&provider.jwksRequests); requests != 2 {
+		t.Errorf("Expected expired JWK set to be refetched, got %d requests", requests)
+	}
+}
+
+func TestJWKSCacheFetchFailureBackoff(t *testing.T) {
+	provider := newTestProvider(t)
+	unavailable := true
+	provider.handlers["/jwks"] = func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&provider.jwksRequests, 1)
+		if unavailable {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, provider.jwks())
+	}
+	clock := &fixedClock{now: time.Now()}
+	tm := NewTokenManager(provider.newClient(t, func(c *Config) {
+		c.Clock = clock
+	}))
+	ctx := context.Background()
+	idToken := provider.signToken(t, provider.idTokenClaims())
+
+	// Without cached keys, a failed fetch must not be retried by every request
+	for i := 0; i < 20; i++ {
+		if _, err := tm.ValidateIDToken(ctx, idToken); err == nil {
+			t.Fatal("Expected error while the JWKS endpoint is unavailable, got nil")
+		}
+	}
+	if requests := atomic.LoadInt32(&provider.jwksRequests); requests != 1 {
+		t.Errorf("Expected 1 JWKS request within the minimum interval, got %d", requests)
+	}
+
+	// Once the interval has passed, the fetch is retried
+	unavailable = false
+	clock.now = clock.now.Add(time.Minute)
+	if _, err := tm.ValidateIDToken(ctx, idToken); err != nil {
+		t.Fatalf("Expected token to validate after the provider recovered, got: %v", err)
+	}
+	if requests := atomic.LoadInt32(&provider.jwksRequests); requests != 2 {
+		t.Errorf("Expected 2 JWKS requests, got %d", requests)
+	}
+}
+
+func TestJWKSCacheCancel(t *testing.T) {
+	provider := newTestProvider(t)
+	release := make(chan struct{})
+	provider.handlers["/jwks"] = func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&provider.jwksRequests, 1)
+		<-release
+		writeJSON(w, provider.jwks())
+	}
+	tm := NewTokenManager(provider.newClient(t, nil))
+
+	// The caller that starts the fetch stops waiting when its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tm.keys.getKey(ctx, provider.kid); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+
+	// The fetch continues for other callers
+	result := make(chan error, 1)
+	go func() {
+		_, err := tm.keys.getKey(context.Background(), provider.kid)
+		result <- err
+	}()
+	close(release)
+	if err := <-result; err != nil {
+		t.Errorf("Failed to get key: %v", err)
+	}
+	if requests := atomic.LoadInt32(&provider.jwksRequests); requests != 1 {
+		t.Errorf("Expected 1 JWKS request, got %d", requests)
+	}
+}
+
+// ecJWK returns the JWK representation of an ECDSA public key
+func ecJWK(kid, crv string, key *ecdsa.PublicKey) JWK {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return JWK{
+		Kty: "EC",
+		Use: "sig",
+		Kid: kid,
+		Crv: crv,
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+func TestJWKToPublicKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+
+	validEC := ecJWK("ec", "P-256", &ecKey.PublicKey)
+
+	offCurve := validEC
+	offCurve.Y = base64.RawURLEncoding.EncodeToString(make([]byte, 32))
+
+	wrongCurve := validEC
+	wrongCurve.Crv = "P-384"
+
+	tests := []struct {
+		name        string
+		jwk         JWK
+		expectError bool
+	}{
+		{name: "EC P-256", jwk: validEC},
+		{name: "EC point not on curve", jwk: offCurve, expectError: true},
+		{name: "EC coordinates for another curve", jwk: wrongCurve, expectError: true},
+		{name: "EC unsupported curve", jwk: JWK{Kty: "EC", Crv: "secp256k1", X: validEC.X, Y: validEC.Y}, expectError: true},
+		{name: "Ed25519", jwk: JWK{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(edKey)}},
+		{name: "X25519 is not a signing key", jwk: JWK{Kty: "OKP", Crv: "X25519", X: base64.RawURLEncoding.EncodeToString(edKey)}, expectError: true},
+		{name: "unknown key type", jwk: JWK{Kty: "oct"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := jwkToPublicKey(&tt.jwk)
+
+			if tt.expectError && err == nil {
+				t.Error("Expected conversion error, got nil")
+			}
+
+			if !tt.expectError && err != nil {
+				t.Errorf("Expected no conversion error, got: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package civicauth
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultLoopbackTimeout bounds how long AuthorizeWithLoopback waits for the user
+	defaultLoopbackTimeout = 5 * time.Minute
+
+	// loopbackShutdownTimeout is how long the listener may take to finish serving the result page
+	loopbackShutdownTimeout = 5 * time.Second
+)
+
+const (
+	loopbackSuccessPage = `<!DOCTYPE html>
+<html><head><title>Signed in</title></head>
+<body><h1>Signed in</h1><p>You can close this window and return to the application.</p></body></html>`
+
+	loopbackFailurePage = `<!DOCTYPE html>
+<html><head><title>Sign-in failed</title></head>
+<body><h1>Sign-in failed</h1><p>%s</p><p>You can close this window and return to the application.</p></body></html>`
+)
+
+// LoopbackOptions configures AuthorizeWithLoopback
+type LoopbackOptions struct {
+	// AuthCodeURLOptions adds prompt, max_age, login_hint and acr_values to the
+	// authorization request (optional; state, nonce, PKCE and the redirect URL are
+	// always generated)
+	AuthCodeURLOptions *AuthCodeURLOptions
+
+	// CallbackPath is the path of the redirect URL (default: /callback)
+	CallbackPath string
+
+	// Port to listen on (default: 0, an ephemeral port chosen by the OS)
+	Port int
+
+	// OpenBrowser opens the authorization URL (default: the system browser)
+	OpenBrowser func(authURL string) error
+
+	// TokenManager validates the ID token and its nonce when set (optional)
+	TokenManager *TokenManager
+
+	// Timeout bounds how long to wait for the user to sign in (default: 5 minutes)
+	Timeout time.Duration
+}
+
+// LoopbackResult is the outcome of a successful AuthorizeWithLoopback
+type LoopbackResult struct {
+	// Tokens returned by the code exchange
+	Tokens *TokenResponse
+
+	// Claims of the validated ID token, set when LoopbackOptions.TokenManager is used
+	Claims *Claims
+}
+
+// AuthorizeWithLoopback signs the user in from a native application using a loopback
+// redirect (RFC 8252). It listens on 127.0.0.1, builds the redirect URL from the
+// chosen port, opens the browser on the authorization URL and waits for the callback.
+// The callback's state is verified before the code is exchanged, and the browser is
+// shown a success or failure page. The provider must accept loopback redirect URIs
+// with any port for the client.
+func (c *Client) AuthorizeWithLoopback(ctx context.Context, opts *LoopbackOptions) (*LoopbackResult, error) {
+	if opts == nil {
+		opts = &LoopbackOptions{}
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultLoopbackTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	callbackPath := opts.CallbackPath
+	if callbackPath == "" {
+		callbackPath = "/callback"
+	}
+
+	openBrowser := opts.OpenBrowser
+	if openBrowser == nil {
+		openBrowser = OpenBrowser
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(opts.Port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start loopback listener: %w", err)
+	}
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	redirectURL := fmt.Sprintf("http://127.0.0.1:%d%s", port, callbackPath)
+
+	flowOpts := &AuthCodeURLOptions{}
+	if opts.AuthCodeURLOptions != nil {
+		*flowOpts = *opts.AuthCodeURLOptions
+	}
+	flowOpts.RedirectURL = redirectURL
+
+	authURL, state, nonce, codeVerifier, err := c.CreateAuthorizationFlowWithOptions(flowOpts)
+	if err != nil {
+		return nil, err
+	}
+	flow := &AuthFlow{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		RedirectURL:  redirectURL,
+		MaxAge:       flowOpts.MaxAge,
+		ACRValues:    flowOpts.ACRValues,
+	}
+
+	type outcome struct {
+		result *LoopbackResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(callbackPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+
+		// Requests without the flow's state, such as a stray request from another local
+		// process or a browser prefetch, are rejected without ending the flow
+		if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("state")), []byte(flow.State)) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, loopbackFailurePage, "invalid state parameter")
+			return
+		}
+
+		result, err := c.handleAuthorizationCallback(ctx, r, flow, opts.TokenManager)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, loopbackFailurePage, html.EscapeString(err.Error()))
+		} else {
+			fmt.Fprint(w, loopbackSuccessPage)
+		}
+
+		// Only the first callback with the flow's state completes the flow
+		select {
+		case done <- outcome{result, err}:
+		default:
+		}
+	})
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), loopbackShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := openBrowser(authURL); err != nil {
+		return nil, fmt.Errorf("failed to open browser: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("loopback authorization failed: %w", ctx.Err())
+	case o := <-done:
+		if o.err != nil {
+			return nil, fmt.Errorf("loopback authorization failed: %w", o.err)
+		}
+		return o.result, nil
+	}
+}
+
+// handleAuthorizationCallback checks the redirect parameters against flow, exchanges
+// the code and validates the ID token if a token manager is given
+func (c *Client) handleAuthorizationCallback(ctx context.Context, r *http.Request, flow *AuthFlow, tm *TokenManager) (*LoopbackResult, error) {
+	query := r.URL.Query()
+
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(flow.State)) != 1 {
+		return nil, fmt.Errorf("invalid state parameter")
+	}
+
+	if code := query.Get("error"); code != "" {
+		return nil, &OAuth2Error{
+			Code:        code,
+			Description: query.Get("error_description"),
+			URI:         query.Get("error_uri"),
+		}
+	}
+
+	code := query.Get("code")
+	if code == "" {
+		return nil, fmt.Errorf("authorization code not found in callback")
+	}
+
+	redirectURL := flow.RedirectURL
+	if redirectURL == "" {
+		redirectURL = c.config.RedirectURL
+	}
+	tokens, err := c.exchangeCode(ctx, code, flow.CodeVerifier, redirectURL)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &LoopbackResult{Tokens: tokens}
+	if tm != nil {
+		if tokens.IDToken == "" {
+			return nil, fmt.Errorf("token response does not contain an ID token")
+		}
+		claims, err := tm.ValidateIDTokenWithOptions(ctx, tokens.IDToken, &IDTokenValidationOptions{
+			Nonce:       flow.Nonce,
+			MaxAge:      flow.MaxAge,
+			ACRValues:   flow.ACRValues,
+			AccessToken: tokens.AccessToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+		result.Claims = claims
+	}
+
+	return result, nil
+}
+
+// OpenBrowser opens url in the system's default browser
+func OpenBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
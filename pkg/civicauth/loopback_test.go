@@ -0,0 +1,219 @@
+package civicauth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// browserCallback returns an OpenBrowser function that simulates the user signing
+// in: it calls the redirect URI from the authorization URL with the query built by
+// callback, and records the page served by the loopback listener
+func browserCallback(t *testing.T, callback func(authQuery url.Values) url.Values, page chan<- string) func(string) error {
+	return func(authURL string) error {
+		parsed, err := url.Parse(authURL)
+		if err != nil {
+			return err
+		}
+		authQuery := parsed.Query()
+		callbackURL := authQuery.Get("redirect_uri") + "?" + callback(authQuery).Encode()
+
+		go func() {
+			resp, err := http.Get(callbackURL)
+			if err != nil {
+				t.Errorf("Callback request failed: %v", err)
+				page <- ""
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			page <- string(body)
+		}()
+		return nil
+	}
+}
+
+func TestAuthorizeWithLoopback(t *testing.T) {
+	provider := newTestProvider(t)
+
+	var authQuery url.Values
+	provider.handlers["/token"] = func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "auth-code" || r.PostFormValue("code_verifier") == "" {
+			t.Errorf("Expected code and code verifier in token request, got %v", r.PostForm)
+		}
+		if r.PostFormValue("redirect_uri") != authQuery.Get("redirect_uri") {
+			t.Errorf("Expected redirect_uri %s, got %s", authQuery.Get("redirect_uri"), r.PostFormValue("redirect_uri"))
+		}
+
+		claims := provider.idTokenClaims()
+		claims["nonce"] = authQuery.Get("nonce")
+		writeJSON(w, &TokenResponse{
+			AccessToken: "access-token",
+			IDToken:     provider.signToken(t, claims),
+			TokenType:   "Bearer",
+			ExpiresIn:   3600,
+		})
+	}
+
+	client := provider.newClient(t, nil)
+	page := make(chan string, 1)
+	result, err := client.AuthorizeWithLoopback(context.Background(), &LoopbackOptions{
+		AuthCodeURLOptions: &AuthCodeURLOptions{Prompt: "login"},
+		TokenManager:       NewTokenManager(client),
+		OpenBrowser: browserCallback(t, func(q url.Values) url.Values {
+			authQuery = q
+			return url.Values{"code": {"auth-code"}, "state": {q.Get("state")}}
+		}, page),
+	})
+	if err != nil {
+		t.Fatalf("Loopback authorization failed: %v", err)
+	}
+
+	redirectURL, err := url.Parse(authQuery.Get("redirect_uri"))
+	if err != nil || redirectURL.Hostname() != "127.0.0.1" || redirectURL.Port() == "" || redirectURL.Path != "/callback" {
+		t.Errorf("Expected loopback redirect URI with an ephemeral port, got %s", authQuery.Get("redirect_uri"))
+	}
+	if authQuery.Get("prompt") != "login" || authQuery.Get("code_challenge") == "" {
+		t.Errorf("Expected prompt and code challenge in the auth URL, got %v", authQuery)
+	}
+	if result.Tokens.AccessToken != "access-token" || result.Claims == nil || result.Claims.Subject != "user123" {
+		t.Errorf("Expected tokens and validated claims, got %+v", result)
+	}
+	if body := <-page; !strings.Contains(body, "Signed in") {
+		t.Errorf("Expected success page, got %q", body)
+	}
+}
+
+func TestAuthorizeWithLoopbackErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		callback func(url.Values) url.Values
+		expected error
+	}{
+		{
+			name: "access denied",
+			callback: func(q url.Values) url.Values {
+				return url.Values{"error": {"access_denied"}, "error_description": {"<b>User cancelled</b>"}, "state": {q.Get("state")}}
+			},
+			expected: ErrAccessDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestProvider(t)
+			provider.handlers["/token"] = func(w http.ResponseWriter, r *http.Request) {
+				t.Error("Expected no token request")
+			}
+
+			client := provider.newClient(t, nil)
+			page := make(chan string, 1)
+			_, err := client.AuthorizeWithLoopback(context.Background(), &LoopbackOptions{
+				OpenBrowser: browserCallback(t, tt.callback, page),
+			})
+			if err == nil {
+				t.Fatal("Expected error, got nil")
+			}
+			if tt.expected != nil && !errors.Is(err, tt.expected) {
+				t.Errorf("Expected %v, got: %v", tt.expected, err)
+			}
+
+			body := <-page
+			if !strings.Contains(body, "Sign-in failed") || strings.Contains(body, "<b>") {
+				t.Errorf("Expected escaped failure page, got %q", body)
+			}
+		})
+	}
+}
+
+func TestAuthorizeWithLoopbackACRValues(t *testing.T) {
+	provider := newTestProvider(t)
+
+	var authQuery url.Values
+	provider.handlers["/token"] = func(w http.ResponseWriter, r *http.Request) {
+		// The provider ignores the requested acr_values
+		claims := provider.idTokenClaims()
+		claims["nonce"] = authQuery.Get("nonce")
+		writeJSON(w, &TokenResponse{AccessToken: "access-token", IDToken: provider.signToken(t, claims), TokenType: "Bearer"})
+	}
+
+	client := provider.newClient(t, nil)
+	page := make(chan string, 1)
+	_, err := client.AuthorizeWithLoopback(context.Background(), &LoopbackOptions{
+		AuthCodeURLOptions: &AuthCodeURLOptions{ACRValues: []string{"urn:high"}},
+		TokenManager:       NewTokenManager(client),
+		OpenBrowser: browserCallback(t, func(q url.Values) url.Values {
+			authQuery = q
+			return url.Values{"code": {"auth-code"}, "state": {q.Get("state")}}
+		}, page),
+	})
+	if err == nil {
+		t.Error("Expected an ID token without the requested acr to be rejected, got nil")
+	}
+	if authQuery.Get("acr_values") != "urn:high" {
+		t.Errorf("Expected acr_values in the authorization request, got %v", authQuery)
+	}
+	<-page
+}
+
+func TestAuthorizeWithLoopbackIgnoresStateMismatch(t *testing.T) {
+	provider := newTestProvider(t)
+	var requests []*http.Request
+	provider.handlers["/token"] = tokenHandler(t, &requests)
+	client := provider.newClient(t, nil)
+	page := make(chan string, 1)
+
+	_, err := client.AuthorizeWithLoopback(context.Background(), &LoopbackOptions{
+		OpenBrowser: func(authURL string) error {
+			parsed, err := url.Parse(authURL)
+			if err != nil {
+				return err
+			}
+			redirectURI := parsed.Query().Get("redirect_uri")
+
+			// A stray request without the flow's state must not end the flow
+			for _, query := range []string{"", "?code=auth-code&state=forged-state"} {
+				resp, err := http.Get(redirectURI + query)
+				if err != nil {
+					return err
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "Sign-in failed") {
+					t.Errorf("Expected request %q to be rejected, got %d %q", query, resp.StatusCode, body)
+				}
+			}
+
+			return browserCallback(t, func(q url.Values) url.Values {
+				return url.Values{"code": {"auth-code"}, "state": {q.Get("state")}}
+			}, page)(authURL)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected the callback with the flow's state to complete the flow, got: %v", err)
+	}
+	if len(requests) != 1 {
+		t.Errorf("Expected a single token request, got %d", len(requests))
+	}
+	if body := <-page; !strings.Contains(body, "Signed in") {
+		t.Errorf("Expected success page, got %q", body)
+	}
+}
+
+func TestAuthorizeWithLoopbackTimeout(t *testing.T) {
+	provider := newTestProvider(t)
+	client := provider.newClient(t, nil)
+
+	_, err := client.AuthorizeWithLoopback(context.Background(), &LoopbackOptions{
+		Timeout:     50 * time.Millisecond,
+		OpenBrowser: func(string) error { return nil },
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package civicauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenValidator validates a bearer token and returns its claims. ValidateIDToken,
+// AccessTokenValidator.ValidateAccessToken and Introspector.ValidateToken can be used.
+type TokenValidator func(ctx context.Context, token string) (*Claims, error)
+
+// BearerAuthOptions configures BearerAuth
+type BearerAuthOptions struct {
+	// Validate validates the bearer token (default: the token manager's ValidateIDToken)
+	Validate TokenValidator
+
+	// Realm is sent in the WWW-Authenticate challenge (optional)
+	Realm string
+
+	// AllowFormParameter accepts the token in an access_token form body parameter
+	// (RFC 6750 section 2.2)
+	AllowFormParameter bool
+
+	// AllowQueryParameter accepts the token in an access_token query parameter
+	// (RFC 6750 section 2.3). Tokens in URLs are easily leaked through logs and
+	// referrers, so this should only be enabled when no other method is possible.
+	AllowQueryParameter bool
+}
+
+// BearerAuth is net/http middleware that authenticates requests with a bearer token
+// (RFC 6750) and stores the token and its claims in the request context
+type BearerAuth struct {
+	opts BearerAuthOptions
+}
+
+// contextKey is the type of the request context keys set by BearerAuth
+type contextKey int
+
+const (
+	claimsContextKey contextKey = iota
+	tokenContextKey
+)
+
+// NewBearerAuth creates bearer token middleware validating tokens with tm, unless
+// opts supplies another validator, in which case tm may be nil
+func NewBearerAuth(tm *TokenManager, opts *BearerAuthOptions) (*BearerAuth, error) {
+	b := &BearerAuth{}
+	if opts != nil {
+		b.opts = *opts
+	}
+	if b.opts.Validate == nil {
+		if tm == nil {
+			return nil, fmt.Errorf("bearer auth requires a token manager or a Validate function")
+		}
+		b.opts.Validate = tm.ValidateIDToken
+	}
+	return b, nil
+}
+
+// Middleware wraps next, rejecting requests without a valid bearer token with a 401
+// (or 400 for malformed requests) and a WWW-Authenticate challenge. When the token
+// cannot be validated because the provider is unreachable or failing, the request is
+// rejected with a 503 (or 500 if the client is not initialized) and no challenge, so
+// that clients do not discard a token that may be valid.
+func (b *BearerAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := b.extractToken(r)
+		if err != nil {
+			b.writeError(w, http.StatusBadRequest, &OAuth2Error{Code: "invalid_request", Description: err.Error()}, nil)
+			return
+		}
+		if token == "" {
+			b.writeError(w, http.StatusUnauthorized, nil, nil)
+			return
+		}
+
+		claims, err := b.opts.Validate(r.Context(), token)
+		if err != nil {
+			if errors.Is(err, ErrInsufficientScope) {
+				b.writeInsufficientScope(w, err)
+				return
+			}
+			if status := unavailableStatus(err); status != 0 {
+				w.Header().Set("Cache-Control", "no-store")
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			b.writeError(w, http.StatusUnauthorized, &OAuth2Error{Code: "invalid_token", Description: invalidTokenDescription(err)}, nil)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		ctx = context.WithValue(ctx, tokenContextKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// extractToken returns the bearer token of the request, or an empty string if there
+// is none. Using more than one method to send the token is an error.
+func (b *BearerAuth) extractToken(r *http.Request) (string, error) {
+	var tokens []string
+
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, _ := strings.Cut(header, " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			token = strings.TrimSpace(token)
+			if token == "" {
+				return "", fmt.Errorf("empty bearer token")
+			}
+			tokens = append(tokens, token)
+		}
+	}
+
+	if b.opts.AllowFormParameter && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == "application/x-www-form-urlencoded" {
+			if token := r.PostFormValue("access_token"); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+
+	if b.opts.AllowQueryParameter {
+		if token := r.URL.Query().Get("access_token"); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+
+	switch len(tokens) {
+	case 0:
+		return "", nil
+	case 1:
+		return tokens[0], nil
+	default:
+		return "", fmt.Errorf("multiple bearer tokens in request")
+	}
+}
+
+// writeError responds with status and a Bearer WWW-Authenticate challenge carrying
+// the error and required scope, if any (RFC 6750 section 3)
+func (b *BearerAuth) writeError(w http.ResponseWriter, status int, oauthErr *OAuth2Error, scope []string) {
+	var params []string
+	if b.opts.Realm != "" {
+		params = append(params, "realm="+quoteParam(b.opts.Realm))
+	}
+	if oauthErr != nil {
+		params = append(params, "error="+quoteParam(oauthErr.Code))
+		if oauthErr.Description != "" {
+			params = append(params, "error_description="+quoteParam(oauthErr.Description))
+		}
+	}
+	if len(scope) > 0 {
+		params = append(params, "scope="+quoteParam(strings.Join(scope, " ")))
+	}
+
+	challenge := "Bearer"
+	if len(params) > 0 {
+		challenge += " " + strings.Join(params, ", ")
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, http.StatusText(status), status)
+}
+
+// quoteParam encodes an auth-param value as an HTTP quoted-string
+func quoteParam(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// unavailableStatus returns the response status for errors that prevented the token
+// from being validated, or 0 if the token itself was rejected
+func unavailableStatus(err error) int {
+	var oauthErr *OAuth2Error
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrProviderNotInitialized):
+		return http.StatusInternalServerError
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &oauthErr) && oauthErr.Retryable():
+		return http.StatusServiceUnavailable
+	}
+	return 0
+}
+
+// invalidTokenDescription describes a validation failure without revealing details
+// that would help an attacker craft a token
+func invalidTokenDescription(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "The access token expired"
+	case errors.Is(err, jwt.ErrTokenNotValidYet):
+		return "The access token is not valid yet"
+	default:
+		return "The access token is invalid"
+	}
+}
+
+// ClaimsFromContext returns the claims stored by BearerAuth in the request context
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*Claims)
+	return claims, ok
+}
+
+// TokenFromContext returns the bearer token stored by BearerAuth in the request context
+func TokenFromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(tokenContextKey).(string)
+	return token, ok
+}
+
+// ValidateToken introspects token and converts an active result into Claims, so that
+// an Introspector can be used as BearerAuthOptions.Validate. Inactive tokens are
+// rejected with ErrInvalidToken.
+func (i *Introspector) ValidateToken(ctx context.Context, token string) (*Claims, error) {
+	resp, err := i.Introspect(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Active {
+		return nil, fmt.Errorf("token is not active: %w", ErrInvalidToken)
+	}
+
+	// Do not trust an active result past the token's own expiry
+	if resp.Expiry != 0 && !i.Client.config.Clock.Now().Before(time.Unix(resp.Expiry, 0)) {
+		return nil, fmt.Errorf("token is expired: %w", ErrInvalidToken)
+	}
+
+	return &Claims{
+		Issuer:            resp.Issuer,
+		Subject:           resp.Subject,
+		Audience:          resp.Audience,
+		Expiry:            resp.Expiry,
+		NotBefore:         resp.NotBefore,
+		IssuedAt:          resp.IssuedAt,
+		JWTID:             resp.JWTID,
+		ClientID:          resp.ClientID,
+		Scope:             resp.Scope,
+		PreferredUsername: resp.Username,
+		Extra:             resp.Extra,
+	}, nil
+}
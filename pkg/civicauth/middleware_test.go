@@ -0,0 +1,279 @@
+package civicauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// claimsHandler responds with the subject and token stored in the request context
+var claimsHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, "no claims", http.StatusInternalServerError)
+		return
+	}
+	token, _ := TokenFromContext(r.Context())
+	fmt.Fprintf(w, "%s %s", claims.Subject, token)
+})
+
+// staticValidator accepts only the token "good-token"
+func staticValidator(ctx context.Context, token string) (*Claims, error) {
+	switch token {
+	case "good-token":
+		return &Claims{Subject: "user123"}, nil
+	case "expired-token":
+		return nil, fmt.Errorf("failed to parse and verify access token: %w", jwt.ErrTokenExpired)
+	default:
+		return nil, fmt.Errorf("invalid token")
+	}
+}
+
+// newBearerAuth creates bearer token middleware, failing the test on error
+func newBearerAuth(t *testing.T, tm *TokenManager, opts *BearerAuthOptions) *BearerAuth {
+	t.Helper()
+	auth, err := NewBearerAuth(tm, opts)
+	if err != nil {
+		t.Fatalf("Failed to create bearer auth: %v", err)
+	}
+	return auth
+}
+
+func TestNewBearerAuthRequiresValidator(t *testing.T) {
+	if _, err := NewBearerAuth(nil, nil); err == nil {
+		t.Error("Expected error without a token manager or Validate function, got nil")
+	}
+	if _, err := NewBearerAuth(nil, &BearerAuthOptions{Realm: "orders"}); err == nil {
+		t.Error("Expected error for options without a Validate function, got nil")
+	}
+}
+
+func TestBearerAuthMiddleware(t *testing.T) {
+	auth := newBearerAuth(t, nil, &BearerAuthOptions{
+		Validate:            staticValidator,
+		Realm:               "orders",
+		AllowFormParameter:  true,
+		AllowQueryParameter: true,
+	})
+	handler := auth.Middleware(claimsHandler)
+
+	tests := []struct {
+		name           string
+		request        func() *http.Request
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name: "authorization header",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/orders", nil)
+				r.Header.Set("Authorization", "Bearer good-token")
+				return r
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "form parameter",
+			request: func() *http.Request {
+				r := httptest.NewRequest("POST", "/orders", strings.NewReader(url.Values{"access_token": {"good-token"}}.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				return r
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "query parameter",
+			request:        func() *http.Request { return httptest.NewRequest("GET", "/orders?access_token=good-token", nil) },
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "missing token",
+			request:        func() *http.Request { return httptest.NewRequest("GET", "/orders", nil) },
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "other scheme",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/orders", nil)
+				r.SetBasicAuth("user", "password")
+				return r
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "invalid token",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/orders", nil)
+				r.Header.Set("Authorization", "Bearer forged-token")
+				return r
+			},
+			expectedStatus: http.StatusUnauthorized,
+			expectedError:  "invalid_token",
+		},
+		{
+			name: "empty bearer token",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/orders", nil)
+				r.Header.Set("Authorization", "Bearer ")
+				return r
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_request",
+		},
+		{
+			name: "multiple methods",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/orders?access_token=good-token", nil)
+				r.Header.Set("Authorization", "Bearer good-token")
+				return r
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, tt.request())
+
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tt.expectedStatus, rec.Code)
+			}
+			if rec.Code == http.StatusOK {
+				if rec.Body.String() != "user123 good-token" {
+					t.Errorf("Expected claims and token in context, got %q", rec.Body.String())
+				}
+				return
+			}
+
+			params := parseBearerChallenge(rec.Header().Get("WWW-Authenticate"))
+			if params["realm"] != "orders" {
+				t.Errorf("Expected realm orders, got %q", params["realm"])
+			}
+			if params["error"] != tt.expectedError {
+				t.Errorf("Expected error %q, got %q", tt.expectedError, params["error"])
+			}
+		})
+	}
+}
+
+func TestBearerAuthParametersDisabled(t *testing.T) {
+	handler := newBearerAuth(t, nil, &BearerAuthOptions{Validate: staticValidator}).Middleware(claimsHandler)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/orders?access_token=good-token", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected query parameter to be ignored by default, got status %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/orders", nil)
+	r.Header.Set("Authorization", "Bearer expired-token")
+	handler.ServeHTTP(rec, r)
+	if params := parseBearerChallenge(rec.Header().Get("WWW-Authenticate")); params["error_description"] != "The access token expired" {
+		t.Errorf("Expected expiry description, got %q", params["error_description"])
+	}
+}
+
+func TestBearerAuthValidationUnavailable(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedStatus int
+	}{
+		{name: "provider not initialized", err: ErrProviderNotInitialized, expectedStatus: http.StatusInternalServerError},
+		{name: "server error", err: fmt.Errorf("token introspection failed: %w", &OAuth2Error{StatusCode: http.StatusBadGateway}), expectedStatus: http.StatusServiceUnavailable},
+		{name: "temporarily unavailable", err: &OAuth2Error{Code: "temporarily_unavailable", StatusCode: http.StatusBadRequest}, expectedStatus: http.StatusServiceUnavailable},
+		{name: "network error", err: fmt.Errorf("failed to fetch JWK set: %w", &url.Error{Op: "Get", URL: "https://example.com", Err: fmt.Errorf("connection refused")}), expectedStatus: http.StatusServiceUnavailable},
+		{name: "context canceled", err: fmt.Errorf("failed to get public key: %w", context.Canceled), expectedStatus: http.StatusServiceUnavailable},
+		{name: "token rejected by introspection", err: fmt.Errorf("token is not active: %w", ErrInvalidToken), expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newBearerAuth(t, nil, &BearerAuthOptions{
+				Validate: func(ctx context.Context, token string) (*Claims, error) { return nil, tt.err },
+			}).Middleware(claimsHandler)
+
+			r := httptest.NewRequest("GET", "/orders", nil)
+			r.Header.Set("Authorization", "Bearer some-token")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tt.expectedStatus, rec.Code)
+			}
+			challenge := rec.Header().Get("WWW-Authenticate")
+			if tt.expectedStatus == http.StatusUnauthorized {
+				if parseBearerChallenge(challenge)["error"] != "invalid_token" {
+					t.Errorf("Expected invalid_token challenge, got %q", challenge)
+				}
+			} else if challenge != "" {
+				t.Errorf("Expected no challenge when the token could not be validated, got %q", challenge)
+			}
+		})
+	}
+
+	// A failing JWKS endpoint must not be reported as an invalid token
+	provider := newTestProvider(t)
+	provider.handlers["/jwks"] = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	handler := newBearerAuth(t, NewTokenManager(provider.newClient(t, nil)), nil).Middleware(claimsHandler)
+	r := httptest.NewRequest("GET", "/orders", nil)
+	r.Header.Set("Authorization", "Bearer "+provider.signToken(t, provider.idTokenClaims()))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 while the JWKS endpoint fails, got %d", rec.Code)
+	}
+}
+
+func TestBearerAuthWithTokenManager(t *testing.T) {
+	provider := newTestProvider(t)
+	handler := newBearerAuth(t, NewTokenManager(provider.newClient(t, nil)), nil).Middleware(claimsHandler)
+
+	token := provider.signToken(t, provider.idTokenClaims())
+	r := httptest.NewRequest("GET", "/orders", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "user123 "+token {
+		t.Errorf("Expected request to be authenticated with an ID token, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestIntrospectorValidateToken(t *testing.T) {
+	var requests int32
+	now := time.Now()
+	provider := introspectionProvider(t, map[string]map[string]interface{}{
+		"active-token":  {"active": true, "sub": "user123", "scope": "orders:read", "client_id": "orders-client", "exp": now.Add(time.Hour).Unix()},
+		"expired-token": {"active": true, "sub": "user123", "exp": now.Add(-time.Minute).Unix()},
+	}, &requests)
+
+	introspector := NewIntrospector(provider.newClient(t, nil), nil)
+	ctx := context.Background()
+
+	claims, err := introspector.ValidateToken(ctx, "active-token")
+	if err != nil {
+		t.Fatalf("Failed to validate token: %v", err)
+	}
+	if claims.Subject != "user123" || claims.ClientID != "orders-client" || !claims.Scope.Contains("orders:read") {
+		t.Errorf("Expected claims from introspection, got %+v", claims)
+	}
+
+	for _, token := range []string{"expired-token", "unknown-token"} {
+		if _, err := introspector.ValidateToken(ctx, token); err == nil {
+			t.Errorf("Expected %s to be rejected", token)
+		}
+	}
+}
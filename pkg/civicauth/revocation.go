@@ -0,0 +1,83 @@
+package civicauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Token type hints for revocation and introspection requests (RFC 7009 section 2.1)
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// RevokeToken revokes an access or refresh token at the provider's revocation endpoint
+// (RFC 7009). The hint (TokenTypeHintAccessToken or TokenTypeHintRefreshToken) is
+// optional. Revoking a token that is already invalid succeeds.
+func (c *Client) RevokeToken(ctx context.Context, token, tokenTypeHint string) error {
+	if c.provider == nil {
+		return ErrProviderNotInitialized
+	}
+	if c.provider.RevocationEndpoint == "" {
+		return fmt.Errorf("revocation endpoint not available")
+	}
+
+	data := url.Values{
+		"token": []string{token},
+	}
+	if tokenTypeHint != "" {
+		data.Set("token_type_hint", tokenTypeHint)
+	}
+
+	resp, body, err := c.postForm(ctx, c.provider.RevocationEndpoint, data)
+	if err != nil {
+		return fmt.Errorf("token revocation failed: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token revocation failed: %w", parseErrorResponse(resp, body))
+	}
+
+	return nil
+}
+
+// Logout signs a user out: it revokes the user's stored refresh token (or the access
+// token if there is none) when the provider supports revocation, deletes the tokens
+// from storage, and returns the RP-initiated logout URL with the stored ID token as
+// id_token_hint. The tokens are deleted even if revocation fails; in that case the
+// logout URL is returned together with the revocation error.
+func (trm *TokenRefreshManager) Logout(ctx context.Context, userID, postLogoutRedirectURI string) (string, error) {
+	tokens, err := trm.storage.Retrieve(userID)
+	if err != nil {
+		// Nothing is stored, so there is nothing to revoke
+		tokens = &TokenResponse{}
+	}
+
+	revokeErr := trm.Client.revokeTokens(ctx, tokens)
+
+	if err := trm.storage.Delete(userID); err != nil {
+		return "", fmt.Errorf("failed to delete tokens: %w", err)
+	}
+
+	logoutURL, err := trm.Client.GetLogoutURL(postLogoutRedirectURI, tokens.IDToken)
+	return logoutURL, errors.Join(revokeErr, err)
+}
+
+// revokeTokens revokes the refresh token, or the access token if there is none, when
+// the provider supports revocation
+func (c *Client) revokeTokens(ctx context.Context, tokens *TokenResponse) error {
+	if c.provider == nil || c.provider.RevocationEndpoint == "" {
+		return nil
+	}
+
+	switch {
+	case tokens.RefreshToken != "":
+		return c.RevokeToken(ctx, tokens.RefreshToken, TokenTypeHintRefreshToken)
+	case tokens.AccessToken != "":
+		return c.RevokeToken(ctx, tokens.AccessToken, TokenTypeHintAccessToken)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package civicauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRevokeToken(t *testing.T) {
+	provider := newTestProvider(t)
+	provider.metadata["revocation_endpoint"] = provider.server.URL + "/revoke"
+	var requests []*http.Request
+	provider.handlers["/revoke"] = func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Failed to parse revocation request: %v", err)
+		}
+		requests = append(requests, r)
+		if r.PostForm.Get("token_type_hint") == "id_token" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"unsupported_token_type"}`))
+		}
+	}
+
+	client := provider.newClient(t, nil)
+	ctx := context.Background()
+
+	if err := client.RevokeToken(ctx, "refresh-token", TokenTypeHintRefreshToken); err != nil {
+		t.Fatalf("Token revocation failed: %v", err)
+	}
+	form := requests[0].PostForm
+	if form.Get("token") != "refresh-token" || form.Get("token_type_hint") != TokenTypeHintRefreshToken {
+		t.Errorf("Expected token and hint in revocation request, got %v", form)
+	}
+	if _, _, ok := requests[0].BasicAuth(); !ok {
+		t.Error("Expected the client to authenticate the revocation request")
+	}
+
+	if err := client.RevokeToken(ctx, "id-token", "id_token"); !errors.Is(err, ErrUnsupportedTokenType) {
+		t.Errorf("Expected ErrUnsupportedTokenType, got: %v", err)
+	}
+
+	delete(provider.metadata, "revocation_endpoint")
+	withoutRevocation := provider.newClient(t, nil)
+	if err := withoutRevocation.RevokeToken(ctx, "token", ""); err == nil {
+		t.Error("Expected error without a revocation endpoint, got nil")
+	}
+}
+
+func TestTokenRefreshManagerLogout(t *testing.T) {
+	provider := newTestProvider(t)
+	provider.metadata["revocation_endpoint"] = provider.server.URL + "/revoke"
+	var revoked []string
+	fail := false
+	provider.handlers["/revoke"] = func(w http.ResponseWriter, r *http.Request) {
+		revoked = append(revoked, r.PostFormValue("token"))
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+
+	client := provider.newClient(t, nil)
+	storage := NewInMemoryTokenStorage()
+	trm := NewTokenRefreshManager(client, storage)
+	ctx := context.Background()
+
+	storage.Store("user123", &TokenResponse{AccessToken: "access-token", RefreshToken: "refresh-token", IDToken: "id-token"})
+	logoutURL, err := trm.Logout(ctx, "user123", "http://localhost:8080")
+	if err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+
+	if len(revoked) != 1 || revoked[0] != "refresh-token" {
+		t.Errorf("Expected the refresh token to be revoked, got %v", revoked)
+	}
+	if _, err := storage.Retrieve("user123"); err == nil {
+		t.Error("Expected tokens to be deleted from storage")
+	}
+
+	parsed, err := url.Parse(logoutURL)
+	if err != nil {
+		t.Fatalf("Failed to parse logout URL: %v", err)
+	}
+	if parsed.Query().Get("id_token_hint") != "id-token" || parsed.Query().Get("post_logout_redirect_uri") != "http://localhost:8080" {
+		t.Errorf("Expected id_token_hint and post_logout_redirect_uri in logout URL, got %s", logoutURL)
+	}
+
+	// Tokens are deleted and the logout URL is returned even if revocation fails
+	fail = true
+	storage.Store("user123", &TokenResponse{AccessToken: "access-token", IDToken: "id-token"})
+	logoutURL, err = trm.Logout(ctx, "user123", "")
+	if err == nil {
+		t.Error("Expected revocation error, got nil")
+	}
+	if revoked[1] != "access-token" {
+		t.Errorf("Expected the access token to be revoked without a refresh token, got %s", revoked[1])
+	}
+	if logoutURL == "" {
+		t.Error("Expected logout URL despite the revocation error")
+	}
+	if _, err := storage.Retrieve("user123"); err == nil {
+		t.Error("Expected tokens to be deleted despite the revocation error")
+	}
+}
@@ -0,0 +1,257 @@
+package civicauth
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSessionIdleTimeout     = 30 * time.Minute
+	defaultSessionAbsoluteTimeout = 12 * time.Hour
+	defaultSessionSweepInterval   = time.Minute
+)
+
+// Session is a signed-in user's session
+type Session struct {
+	// ID is a random identifier assigned when the session is created
+	ID string `json:"id"`
+
+	// Subject is the user's subject identifier (sub claim)
+	Subject string `json:"sub"`
+
+	// Tokens obtained at login, or by the last refresh
+	Tokens *TokenResponse `json:"tokens,omitempty"`
+
+	// TokensIssuedAt is when Tokens were obtained, for evaluating expires_in
+	TokensIssuedAt time.Time `json:"tokens_issued_at"`
+
+	// Claims of the ID token validated at login
+	Claims *Claims `json:"claims,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// Expiry is when the session ends regardless of activity
+	Expiry time.Time `json:"expiry"`
+}
+
+// SessionStore keeps sessions, bound to the user's browser by a cookie
+type SessionStore interface {
+	// Load returns the session of the request, or ErrSessionNotFound if it has none
+	// or the session expired. Loading a session extends its idle timeout.
+	Load(w http.ResponseWriter, r *http.Request) (*Session, error)
+
+	// Save stores session and sets the session cookie. A session that has not been
+	// saved before is given its creation time and expiry, and an ID if it has none.
+	Save(w http.ResponseWriter, r *http.Request, session *Session) error
+
+	// Delete ends the session of the request, if any, and clears the session cookie
+	Delete(w http.ResponseWriter, r *http.Request) error
+}
+
+// SessionOptions configures a SessionStore
+type SessionOptions struct {
+	// CookieName is the name of the session cookie (default: civicauth_session)
+	CookieName string
+
+	// IdleTimeout ends sessions that have not been used for this long (default: 30 minutes)
+	IdleTimeout time.Duration
+
+	// AbsoluteTimeout ends sessions this long after login (default: 12 hours)
+	AbsoluteTimeout time.Duration
+
+	// Secure restricts the cookie to HTTPS (default: true). Set it to false only to
+	// serve the application over plain HTTP during development.
+	Secure *bool
+
+	// SameSite of the cookie (default: Lax, which the login callback requires)
+	SameSite http.SameSite
+
+	// SweepInterval is how often MemorySessionStore removes expired sessions
+	// (default: 1 minute)
+	SweepInterval time.Duration
+
+	// CookieClaims lists the ID token claims CookieSessionStore keeps in the cookie
+	// (default: iss, sub, aud, exp, iat, auth_time, acr, amr, sid, name,
+	// preferred_username, email and email_verified)
+	CookieClaims []string
+
+	// Clock provides the current time (default: system clock)
+	Clock Clock
+}
+
+// newSessionOptions returns opts with defaults applied
+func newSessionOptions(opts *SessionOptions) SessionOptions {
+	var o SessionOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.CookieName == "" {
+		o.CookieName = defaultSessionCookieName
+	}
+	if o.IdleTimeout == 0 {
+		o.IdleTimeout = defaultSessionIdleTimeout
+	}
+	if o.AbsoluteTimeout == 0 {
+		o.AbsoluteTimeout = defaultSessionAbsoluteTimeout
+	}
+	if o.SameSite == 0 {
+		o.SameSite = http.SameSiteLaxMode
+	}
+	if o.SweepInterval == 0 {
+		o.SweepInterval = defaultSessionSweepInterval
+	}
+	if o.Clock == nil {
+		o.Clock = systemClock{}
+	}
+	return o
+}
+
+// prepare initializes a new session and records its use
+func (o *SessionOptions) prepare(session *Session) error {
+	now := o.Clock.Now()
+	if session.ID == "" {
+		id, err := generateSessionID()
+		if err != nil {
+			return fmt.Errorf("failed to generate session ID: %w", err)
+		}
+		session.ID = id
+	}
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = now
+		session.Expiry = now.Add(o.AbsoluteTimeout)
+	}
+	session.LastSeen = now
+	return nil
+}
+
+// secure reports whether the session cookie is restricted to HTTPS
+func (o *SessionOptions) secure() bool {
+	return o.Secure == nil || *o.Secure
+}
+
+// expired reports whether session reached its absolute or idle timeout
+func (o *SessionOptions) expired(session *Session) bool {
+	now := o.Clock.Now()
+	return !now.Before(session.Expiry) || !now.Before(session.LastSeen.Add(o.IdleTimeout))
+}
+
+// cookie returns a session cookie with the given value, expiring with the session
+func (o *SessionOptions) cookie(name, value string, expiry time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expiry,
+		Secure:   o.secure(),
+		HttpOnly: true,
+		SameSite: o.SameSite,
+	}
+}
+
+// MemorySessionStore is an in-memory SessionStore identifying sessions with a random
+// ID in the session cookie. Expired sessions are removed in the background until Close
+// is called. It is safe for concurrent use but only works for a single server instance.
+type MemorySessionStore struct {
+	opts     SessionOptions
+	mu       sync.Mutex
+	sessions map[string]*Session
+	done     chan struct{}
+	stop     sync.Once
+}
+
+// NewMemorySessionStore creates an in-memory session store
+func NewMemorySessionStore(opts *SessionOptions) *MemorySessionStore {
+	s := &MemorySessionStore{
+		opts:     newSessionOptions(opts),
+		sessions: make(map[string]*Session),
+		done:     make(chan struct{}),
+	}
+	go s.sweep()
+	return s
+}
+
+// Load returns the session named by the session cookie and extends its idle timeout
+func (s *MemorySessionStore) Load(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(s.opts.CookieName)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[cookie.Value]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if s.opts.expired(session) {
+		delete(s.sessions, cookie.Value)
+		clearCookie(w, s.opts.CookieName, s.opts.secure())
+		return nil, ErrSessionNotFound
+	}
+
+	session.LastSeen = s.opts.Clock.Now()
+	loaded := *session
+	return &loaded, nil
+}
+
+// Save stores a copy of session and sets the session cookie to its ID
+func (s *MemorySessionStore) Save(w http.ResponseWriter, r *http.Request, session *Session) error {
+	if err := s.opts.prepare(session); err != nil {
+		return err
+	}
+
+	stored := *session
+	s.mu.Lock()
+	s.sessions[session.ID] = &stored
+	s.mu.Unlock()
+
+	http.SetCookie(w, s.opts.cookie(s.opts.CookieName, session.ID, session.Expiry))
+	return nil
+}
+
+// Delete removes the session named by the session cookie and clears the cookie
+func (s *MemorySessionStore) Delete(w http.ResponseWriter, r *http.Request) error {
+	if cookie, err := r.Cookie(s.opts.CookieName); err == nil {
+		s.mu.Lock()
+		delete(s.sessions, cookie.Value)
+		s.mu.Unlock()
+	}
+	clearCookie(w, s.opts.CookieName, s.opts.secure())
+	return nil
+}
+
+// Close stops the background removal of expired sessions
+func (s *MemorySessionStore) Close() error {
+	s.stop.Do(func() { close(s.done) })
+	return nil
+}
+
+// sweep periodically removes expired sessions until the store is closed
+func (s *MemorySessionStore) sweep() {
+	ticker := time.NewTicker(s.opts.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.removeExpired()
+		}
+	}
+}
+
+// removeExpired deletes every expired session
+func (s *MemorySessionStore) removeExpired() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if s.opts.expired(session) {
+			delete(s.sessions, id)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package civicauth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	clock := &fixedClock{now: time.Now()}
+	sessions := newTestSessionStore(t, &SessionOptions{
+		SameSite: http.SameSiteStrictMode,
+		Clock:    clock,
+	})
+
+	session := &Session{Subject: "user123", Tokens: &TokenResponse{AccessToken: "access-token"}}
+	rec := httptest.NewRecorder()
+	if err := sessions.Save(rec, httptest.NewRequest("GET", "/", nil), session); err != nil {
+		t.Fatalf("Failed to save session: %v", err)
+	}
+
+	if len(session.ID) != 43 {
+		t.Errorf("Expected a random 256-bit session ID, got %q", session.ID)
+	}
+	if !session.CreatedAt.Equal(clock.now) || !session.Expiry.Equal(clock.now.Add(12*time.Hour)) {
+		t.Errorf("Expected creation time and absolute expiry, got %v and %v", session.CreatedAt, session.Expiry)
+	}
+
+	cookie := responseCookie(rec, "civicauth_session")
+	if cookie == nil || cookie.Value != session.ID || !cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("Expected Secure, HttpOnly, SameSite=Strict session cookie, got %+v", cookie)
+	}
+
+	loaded, err := loadSession(sessions, cookie)
+	if err != nil {
+		t.Fatalf("Failed to load session: %v", err)
+	}
+	if loaded.Subject != "user123" || loaded.Tokens.AccessToken != "access-token" {
+		t.Errorf("Unexpected session: %+v", loaded)
+	}
+
+	// Changes to a loaded session are only kept when it is saved
+	loaded.Subject = "changed"
+	if again, _ := loadSession(sessions, cookie); again.Subject != "user123" {
+		t.Errorf("Expected the stored session to be unchanged, got %s", again.Subject)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	if err := sessions.Delete(rec, r); err != nil {
+		t.Fatalf("Failed to delete session: %v", err)
+	}
+	if cleared := responseCookie(rec, "civicauth_session"); cleared == nil || cleared.MaxAge >= 0 {
+		t.Errorf("Expected session cookie to be cleared, got %+v", cleared)
+	}
+	if _, err := loadSession(sessions, cookie); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected ErrSessionNotFound after delete, got: %v", err)
+	}
+}
+
+func TestMemorySessionStoreTimeouts(t *testing.T) {
+	start := time.Now()
+	clock := &fixedClock{now: start}
+	sessions := newTestSessionStore(t, &SessionOptions{
+		IdleTimeout:     10 * time.Minute,
+		AbsoluteTimeout: time.Hour,
+		Clock:           clock,
+	})
+
+	save := func() *http.Cookie {
+		rec := httptest.NewRecorder()
+		if err := sessions.Save(rec, httptest.NewRequest("GET", "/", nil), &Session{Subject: "user123"}); err != nil {
+			t.Fatalf("Failed to save session: %v", err)
+		}
+		return responseCookie(rec, "civicauth_session")
+	}
+
+	active := save()
+	idle := save()
+
+	// Loading a session extends its idle timeout, up to the absolute timeout
+	for elapsed := 8 * time.Minute; elapsed < time.Hour; elapsed += 8 * time.Minute {
+		clock.now = start.Add(elapsed)
+		if _, err := loadSession(sessions, active); err != nil {
+			t.Fatalf("Expected active session after %v, got: %v", elapsed, err)
+		}
+	}
+	if _, err := loadSession(sessions, idle); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected idle session to expire, got: %v", err)
+	}
+
+	clock.now = start.Add(time.Hour)
+	if _, err := loadSession(sessions, active); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected session to expire after the absolute timeout, got: %v", err)
+	}
+}
+
+func TestMemorySessionStoreSweep(t *testing.T) {
+	clock := &fixedClock{now: time.Now()}
+	sessions := newTestSessionStore(t, &SessionOptions{Clock: clock})
+
+	for i := 0; i < 3; i++ {
+		if err := sessions.Save(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), &Session{Subject: "user123"}); err != nil {
+			t.Fatalf("Failed to save session: %v", err)
+		}
+	}
+
+	sessions.removeExpired()
+	if len(sessions.sessions) != 3 {
+		t.Fatalf("Expected 3 active sessions, got %d", len(sessions.sessions))
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	sessions.removeExpired()
+	if len(sessions.sessions) != 0 {
+		t.Errorf("Expected expired sessions to be removed, got %d", len(sessions.sessions))
+	}
+
+	// Close may be called more than once
+	sessions.Close()
+	sessions.Close()
+}
@@ -0,0 +1,95 @@
+package civicauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestExchangeToken(t *testing.T) {
+	provider := newTestProvider(t)
+	var form []string
+	provider.handlers["/token"] = func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Failed to parse token request: %v", err)
+		}
+		if r.PostForm.Get("grant_type") != tokenExchangeGrantType {
+			t.Errorf("Expected token exchange grant type, got %s", r.PostForm.Get("grant_type"))
+		}
+		form = []string{
+			r.PostForm.Get("subject_token"),
+			r.PostForm.Get("subject_token_type"),
+			r.PostForm.Get("actor_token"),
+			r.PostForm.Get("actor_token_type"),
+			r.PostForm.Get("requested_token_type"),
+			r.PostForm.Get("scope"),
+		}
+		if len(r.PostForm["audience"]) != 2 || len(r.PostForm["resource"]) != 1 {
+			t.Errorf("Expected audience and resource parameters, got %v", r.PostForm)
+		}
+		writeJSON(w, map[string]interface{}{
+			"access_token":      "downstream-token",
+			"issued_token_type": TokenTypeAccessToken,
+			"token_type":        "Bearer",
+			"expires_in":        60,
+		})
+	}
+
+	client := provider.newClient(t, nil)
+	tokens, err := client.ExchangeToken(context.Background(), &TokenExchangeRequest{
+		SubjectToken:       "user-access-token",
+		SubjectTokenType:   TokenTypeAccessToken,
+		ActorToken:         "gateway-token",
+		ActorTokenType:     TokenTypeJWT,
+		RequestedTokenType: TokenTypeAccessToken,
+		Audience:           []string{"orders", "billing"},
+		Resource:           []string{"https://orders.internal"},
+		Scopes:             []string{"orders:read"},
+	})
+	if err != nil {
+		t.Fatalf("Token exchange failed: %v", err)
+	}
+
+	expected := []string{"user-access-token", TokenTypeAccessToken, "gateway-token", TokenTypeJWT, TokenTypeAccessToken, "orders:read"}
+	for i := range expected {
+		if form[i] != expected[i] {
+			t.Errorf("Expected parameter %q, got %q", expected[i], form[i])
+		}
+	}
+	if tokens.AccessToken != "downstream-token" || tokens.IssuedTokenType != TokenTypeAccessToken {
+		t.Errorf("Expected issued access token, got %+v", tokens)
+	}
+}
+
+func TestExchangeTokenErrors(t *testing.T) {
+	provider := newTestProvider(t)
+	provider.handlers["/token"] = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_target","error_description":"Unknown audience"}`))
+	}
+
+	client := provider.newClient(t, nil)
+	ctx := context.Background()
+
+	if _, err := client.ExchangeToken(ctx, &TokenExchangeRequest{SubjectToken: "token"}); err == nil {
+		t.Error("Expected error without a subject token type, got nil")
+	}
+	if _, err := client.ExchangeToken(ctx, &TokenExchangeRequest{
+		SubjectToken:     "token",
+		SubjectTokenType: TokenTypeAccessToken,
+		ActorToken:       "actor",
+	}); err == nil {
+		t.Error("Expected error for an actor token without a type, got nil")
+	}
+
+	_, err := client.ExchangeToken(ctx, &TokenExchangeRequest{
+		SubjectToken:     "token",
+		SubjectTokenType: TokenTypeAccessToken,
+		Audience:         []string{"unknown"},
+	})
+	if !errors.Is(err, ErrInvalidTarget) {
+		t.Errorf("Expected ErrInvalidTarget, got: %v", err)
+	}
+}
@@ -2,193 +2,249 @@ package civicauth
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
-	"crypto/x509"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
+	"hash"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// JWK represents a JSON Web Key
-type JWK struct {
-	Kty string   `json:"kty"`
-	Use string   `json:"use"`
-	Kid string   `json:"kid"`
-	X5t string   `json:"x5t"`
-	N   string   `json:"n"`
-	E   string   `json:"e"`
-	X5c []string `json:"x5c"`
-}
-
-// JWKSet represents a set of JSON Web Keys
-type JWKSet struct {
-	Keys []JWK `json:"keys"`
-}
-
 // TokenManager handles token operations
 type TokenManager struct {
-	Client   *Client
-	jwkSet   *JWKSet
-	jwkCache map[string]*rsa.PublicKey
+	Client *Client
+
+	keys *jwksCache
 }
 
 // NewTokenManager creates a new token manager
 func NewTokenManager(client *Client) *TokenManager {
 	return &TokenManager{
-		Client:   client,
-		jwkCache: make(map[string]*rsa.PublicKey),
+		Client: client,
+		keys:   newJWKSCache(client),
 	}
 }
 
-// fetchJWKSet fetches the JWK set from the provider
-func (tm *TokenManager) fetchJWKSet(ctx context.Context) error {
-	if tm.Client.provider == nil {
-		return fmt.Errorf("provider not initialized")
-	}
+// IDTokenValidationOptions holds additional checks applied by ValidateIDTokenWithOptions
+type IDTokenValidationOptions struct {
+	// Nonce is the nonce sent in the authorization request; the token must carry the same value
+	Nonce string
 
-	req, err := http.NewRequestWithContext(ctx, "GET", tm.Client.provider.JwksURI, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create JWK request: %w", err)
-	}
+	// MaxAge is the max_age sent in the authorization request, in seconds. When set, the
+	// token must carry auth_time and the authentication must not be older than MaxAge.
+	MaxAge int
 
-	resp, err := tm.Client.config.HTTPClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to fetch JWK set: %w", err)
-	}
-	defer resp.Body.Close()
+	// RequireAuthTime requires the auth_time claim even when MaxAge is not set
+	RequireAuthTime bool
+
+	// ACRValues are the acceptable authentication context class references; when set,
+	// the token's acr claim must be one of them
+	ACRValues []string
+
+	// AccessToken is the access token issued with the ID token. When set and the token
+	// carries at_hash, the hash must match the access token.
+	AccessToken string
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("JWK request failed with status: %d", resp.StatusCode)
+	// Code is the authorization code returned alongside the ID token in a hybrid flow.
+	// When set, the token must carry a c_hash matching the code.
+	Code string
+}
+
+// ValidateIDToken validates an ID token
+func (tm *TokenManager) ValidateIDToken(ctx context.Context, idToken string) (*Claims, error) {
+	return tm.validateIDToken(ctx, idToken, nil)
+}
+
+// ValidateIDTokenWithNonce validates an ID token and checks that its nonce claim
+// matches the nonce sent in the authorization request
+func (tm *TokenManager) ValidateIDTokenWithNonce(ctx context.Context, idToken, expectedNonce string) (*Claims, error) {
+	if expectedNonce == "" {
+		return nil, fmt.Errorf("expected nonce is required")
 	}
+	return tm.validateIDToken(ctx, idToken, &IDTokenValidationOptions{Nonce: expectedNonce})
+}
 
-	body, err := io.ReadAll(resp.Body)
+// ValidateIDTokenWithOptions validates an ID token and applies the additional checks in opts
+func (tm *TokenManager) ValidateIDTokenWithOptions(ctx context.Context, idToken string, opts *IDTokenValidationOptions) (*Claims, error) {
+	return tm.validateIDToken(ctx, idToken, opts)
+}
+
+// validateIDToken validates an ID token and applies the optional checks in opts
+func (tm *TokenManager) validateIDToken(ctx context.Context, idToken string, opts *IDTokenValidationOptions) (*Claims, error) {
+	token, claims, err := tm.verifyToken(ctx, idToken, "ID token")
 	if err != nil {
-		return fmt.Errorf("failed to read JWK response: %w", err)
+		return nil, err
 	}
 
-	var jwkSet JWKSet
-	if err := json.Unmarshal(body, &jwkSet); err != nil {
-		return fmt.Errorf("failed to decode JWK set: %w", err)
+	// Validate issuer
+	if claims.Issuer != tm.Client.config.Issuer {
+		return nil, fmt.Errorf("invalid issuer: expected %s, got %s", tm.Client.config.Issuer, claims.Issuer)
 	}
 
-	tm.jwkSet = &jwkSet
-	return nil
-}
+	// Validate audience and authorized party
+	if err := tm.validateAudience(claims); err != nil {
+		return nil, err
+	}
 
-// getPublicKey gets the public key for the given key ID
-func (tm *TokenManager) getPublicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
-	// Check cache first
-	if key, exists := tm.jwkCache[kid]; exists {
-		return key, nil
+	// Validate token age
+	if maxAge := tm.Client.config.MaxTokenAge; maxAge > 0 {
+		if claims.IssuedAt == 0 {
+			return nil, fmt.Errorf("token is missing iat")
+		}
+		if tm.Client.config.Clock.Now().Sub(time.Unix(claims.IssuedAt, 0)) > maxAge+tm.Client.config.leeway() {
+			return nil, fmt.Errorf("token was issued more than %v ago", maxAge)
+		}
 	}
 
-	// Fetch JWK set if not already done
-	if tm.jwkSet == nil {
-		if err := tm.fetchJWKSet(ctx); err != nil {
+	if opts != nil {
+		if err := tm.validateOptions(claims, token.Method.Alg(), opts); err != nil {
 			return nil, err
 		}
 	}
 
-	// Find the key with matching kid
-	var jwk *JWK
-	for _, key := range tm.jwkSet.Keys {
-		if key.Kid == kid {
-			jwk = &key
-			break
-		}
+	return claims, nil
+}
+
+// verifyToken checks the signature and time claims of a JWT signed by the provider and
+// decodes its claims. kind names the token in error messages.
+func (tm *TokenManager) verifyToken(ctx context.Context, rawToken, kind string) (*jwt.Token, *Claims, error) {
+	// Reject "none" and HMAC algorithms and anything outside the allowlist up front
+	algs := tm.signingAlgorithms()
+	if err := checkAlgorithm(rawToken, algs); err != nil {
+		return nil, nil, err
 	}
 
-	if jwk == nil {
-		// Refetch JWK set in case it was updated
-		if err := tm.fetchJWKSet(ctx); err != nil {
-			return nil, fmt.Errorf("failed to refetch JWK set: %w", err)
-		}
+	// Parse and verify the token; exp, nbf and iat are checked with the configured leeway
+	token, err := jwt.Parse(rawToken, tm.keyFunc(ctx),
+		jwt.WithValidMethods(algs),
+		jwt.WithTimeFunc(tm.Client.config.Clock.Now),
+		jwt.WithLeeway(tm.Client.config.leeway()),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
 
-		for _, key := range tm.jwkSet.Keys {
-			if key.Kid == kid {
-				jwk = &key
-				break
-			}
-		}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse and verify %s: %w", kind, err)
+	}
 
-		if jwk == nil {
-			return nil, fmt.Errorf("key with kid %s not found", kid)
-		}
+	if !token.Valid {
+		return nil, nil, fmt.Errorf("%s is invalid", kind)
+	}
+
+	// Convert claims to our Claims struct
+	claimsMap, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, nil, fmt.Errorf("failed to get token claims")
 	}
 
-	// Convert JWK to RSA public key
-	publicKey, err := tm.jwkToRSAPublicKey(jwk)
+	claims := &Claims{}
+
+	// Convert map claims to struct
+	claimsJSON, err := json.Marshal(claimsMap)
 	if err != nil {
-		return nil, fmt.Errorf("failed to convert JWK to RSA public key: %w", err)
+		return nil, nil, fmt.Errorf("failed to marshal claims: %w", err)
 	}
 
-	// Cache the key
-	tm.jwkCache[kid] = publicKey
+	if err := json.Unmarshal(claimsJSON, claims); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal claims: %w", err)
+	}
+	claims.Extra = claimsMap
 
-	return publicKey, nil
+	return token, claims, nil
 }
 
-// jwkToRSAPublicKey converts a JWK to an RSA public key
-func (tm *TokenManager) jwkToRSAPublicKey(jwk *JWK) (*rsa.PublicKey, error) {
-	// Try X.509 certificate first
-	if len(jwk.X5c) > 0 {
-		certData, err := base64.StdEncoding.DecodeString(jwk.X5c[0])
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode X.509 certificate: %w", err)
+// validateOptions applies the nonce, auth_time, acr and token hash checks requested in opts
+func (tm *TokenManager) validateOptions(claims *Claims, alg string, opts *IDTokenValidationOptions) error {
+	// Validate nonce
+	if opts.Nonce != "" {
+		if claims.Nonce == "" {
+			return fmt.Errorf("token is missing nonce")
 		}
-
-		cert, err := x509.ParseCertificate(certData)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse X.509 certificate: %w", err)
+		if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(opts.Nonce)) != 1 {
+			return fmt.Errorf("invalid nonce")
 		}
+	}
 
-		rsaKey, ok := cert.PublicKey.(*rsa.PublicKey)
-		if !ok {
-			return nil, fmt.Errorf("certificate does not contain RSA public key")
+	// Validate authentication time
+	if opts.MaxAge > 0 || opts.RequireAuthTime {
+		if claims.AuthTime == 0 {
+			return fmt.Errorf("token is missing auth_time")
+		}
+	}
+	if opts.MaxAge > 0 {
+		maxAge := time.Duration(opts.MaxAge) * time.Second
+		if tm.Client.config.Clock.Now().Sub(time.Unix(claims.AuthTime, 0)) > maxAge+tm.Client.config.leeway() {
+			return fmt.Errorf("authentication is older than max_age of %d seconds", opts.MaxAge)
 		}
-
-		return rsaKey, nil
 	}
 
-	// Fall back to N and E parameters
-	if jwk.N == "" || jwk.E == "" {
-		return nil, fmt.Errorf("JWK missing required parameters")
+	// Validate authentication context class
+	if len(opts.ACRValues) > 0 && !containsString(opts.ACRValues, claims.ACR) {
+		return fmt.Errorf("acr %q does not satisfy requested acr_values %v", claims.ACR, opts.ACRValues)
 	}
 
-	nBytes, err := base64.RawURLEncoding.DecodeString(jwk.N)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode N parameter: %w", err)
+	// Validate access token hash
+	if opts.AccessToken != "" && claims.AccessTokenHash != "" {
+		if err := verifyTokenHash(alg, opts.AccessToken, claims.AccessTokenHash); err != nil {
+			return fmt.Errorf("invalid at_hash: %w", err)
+		}
 	}
 
-	eBytes, err := base64.RawURLEncoding.DecodeString(jwk.E)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode E parameter: %w", err)
+	// Validate authorization code hash
+	if opts.Code != "" {
+		if claims.CodeHash == "" {
+			return fmt.Errorf("token is missing c_hash")
+		}
+		if err := verifyTokenHash(alg, opts.Code, claims.CodeHash); err != nil {
+			return fmt.Errorf("invalid c_hash: %w", err)
+		}
 	}
 
-	// Convert bytes to big integers
-	n := new(rsa.PublicKey)
-	n.N = new(rsa.PublicKey).N.SetBytes(nBytes)
+	return nil
+}
 
-	// E is usually 65537, but decode from bytes to be safe
-	e := 0
-	for _, b := range eBytes {
-		e = e*256 + int(b)
+// verifyTokenHash checks an at_hash or c_hash value: the base64url encoding of the left
+// half of the hash of value, using the hash function of the ID token's signing algorithm
+func verifyTokenHash(alg, value, expected string) error {
+	var h hash.Hash
+	switch {
+	case alg == "EdDSA":
+		// Ed25519 signatures use SHA-512
+		h = sha512.New()
+	case strings.HasSuffix(alg, "256"):
+		h = sha256.New()
+	case strings.HasSuffix(alg, "384"):
+		h = sha512.New384()
+	case strings.HasSuffix(alg, "512"):
+		h = sha512.New()
+	default:
+		return fmt.Errorf("no hash function for algorithm %s", alg)
+	}
+
+	h.Write([]byte(value))
+	sum := h.Sum(nil)
+	actual := base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+
+	if subtle.ConstantTimeCompare([]byte(actual), []byte(expected)) != 1 {
+		return fmt.Errorf("hash does not match")
 	}
-	n.E = e
-
-	return n, nil
+	return nil
 }
 
-// ValidateIDToken validates an ID token
-func (tm *TokenManager) ValidateIDToken(ctx context.Context, idToken string) (*Claims, error) {
-	// Parse the token without verification first to get the header
-	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+// keyFunc returns a jwt.Keyfunc that resolves the token's signing key from the JWK set
+func (tm *TokenManager) keyFunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
 		// Get the key ID from the token header
 		kid, ok := token.Header["kid"].(string)
 		if !ok {
@@ -196,71 +252,151 @@ func (tm *TokenManager) ValidateIDToken(ctx context.Context, idToken string) (*C
 		}
 
 		// Get the public key
-		publicKey, err := tm.getPublicKey(ctx, kid)
+		cached, err := tm.keys.getKey(ctx, kid)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get public key: %w", err)
 		}
 
-		// Ensure the signing method is RS256
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		// Ensure the key is intended for signatures with this algorithm
+		alg := token.Method.Alg()
+		if cached.use != "" && cached.use != "sig" {
+			return nil, fmt.Errorf("key %s has use %q, expected sig", kid, cached.use)
+		}
+		if cached.alg != "" && cached.alg != alg {
+			return nil, fmt.Errorf("key %s is for algorithm %s, token uses %s", kid, cached.alg, alg)
 		}
 
-		return publicKey, nil
-	})
+		// Ensure the key type matches the signing method
+		if !keyMatchesMethod(cached.key, token.Method) {
+			return nil, fmt.Errorf("key %s cannot be used with signing method %s", kid, alg)
+		}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse and verify ID token: %w", err)
+		return cached.key, nil
 	}
+}
 
-	if !token.Valid {
-		return nil, fmt.Errorf("ID token is invalid")
+// signingAlgorithms returns the algorithms accepted for ID token signatures: the
+// configured AllowedAlgorithms, or else the algorithms the provider advertises,
+// defaulting to RS256 as required by OIDC Discovery
+func (tm *TokenManager) signingAlgorithms() []string {
+	if len(tm.Client.config.AllowedAlgorithms) > 0 {
+		return tm.Client.config.AllowedAlgorithms
 	}
 
-	// Convert claims to our Claims struct
-	claimsMap, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, fmt.Errorf("failed to get token claims")
+	var algs []string
+	if tm.Client.provider != nil {
+		for _, alg := range tm.Client.provider.IDTokenSigningAlgValuesSupported {
+			if !isInsecureAlgorithm(alg) {
+				algs = append(algs, alg)
+			}
+		}
 	}
+	if len(algs) == 0 {
+		algs = []string{"RS256"}
+	}
+	return algs
+}
 
-	claims := &Claims{}
-
-	// Convert map claims to struct
-	claimsJSON, err := json.Marshal(claimsMap)
+// checkAlgorithm rejects tokens whose header algorithm is insecure or not allowed
+// before any key lookup takes place
+func checkAlgorithm(rawToken string, allowed []string) error {
+	token, _, err := jwt.NewParser().ParseUnverified(rawToken, jwt.MapClaims{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal claims: %w", err)
+		return fmt.Errorf("malformed token: %w", err)
 	}
 
-	if err := json.Unmarshal(claimsJSON, claims); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal claims: %w", err)
+	alg, _ := token.Header["alg"].(string)
+	if isInsecureAlgorithm(alg) {
+		return fmt.Errorf("%w: %q", ErrInsecureAlgorithm, alg)
+	}
+	if !containsString(allowed, alg) {
+		return fmt.Errorf("%w: %q", ErrAlgorithmNotAllowed, alg)
 	}
 
-	// Validate issuer
-	if claims.Issuer != tm.Client.config.Issuer {
-		return nil, fmt.Errorf("invalid issuer: expected %s, got %s", tm.Client.config.Issuer, claims.Issuer)
+	return nil
+}
+
+// isInsecureAlgorithm reports whether alg must never be accepted for tokens verified
+// with public keys: "none" carries no signature and HMAC algorithms could be forged
+// using a public key as the shared secret
+func isInsecureAlgorithm(alg string) bool {
+	return alg == "" || strings.EqualFold(alg, "none") || strings.HasPrefix(strings.ToUpper(alg), "HS")
+}
+
+// keyMatchesMethod reports whether the public key can verify signatures made with the signing method
+func keyMatchesMethod(key crypto.PublicKey, method jwt.SigningMethod) bool {
+	switch method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodECDSA:
+		_, ok := key.(*ecdsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodEd25519:
+		_, ok := key.(ed25519.PublicKey)
+		return ok
+	default:
+		return false
 	}
+}
 
-	// Validate audience
-	if claims.Audience != tm.Client.config.ClientID {
-		return nil, fmt.Errorf("invalid audience: expected %s, got %s", tm.Client.config.ClientID, claims.Audience)
+// validateAudience checks the aud and azp claims as described in OIDC Core section 3.1.3.7.
+// The ClientID must be one of the audiences, every other audience must be listed in
+// Config.TrustedAudiences, and azp must be present and equal to the ClientID when the
+// token has multiple audiences.
+func (tm *TokenManager) validateAudience(claims *Claims) error {
+	clientID := tm.Client.config.ClientID
+
+	if !claims.Audience.Contains(clientID) {
+		return fmt.Errorf("invalid audience: expected %s, got %v", clientID, []string(claims.Audience))
 	}
 
-	// Validate expiry
-	if time.Unix(claims.Expiry, 0).Before(time.Now()) {
-		return nil, fmt.Errorf("token has expired")
+	for _, aud := range claims.Audience {
+		if aud != clientID && !containsString(tm.Client.config.TrustedAudiences, aud) {
+			return fmt.Errorf("invalid audience: untrusted audience %s", aud)
+		}
 	}
 
-	return claims, nil
+	if len(claims.Audience) > 1 && claims.AuthorizedParty == "" {
+		return fmt.Errorf("token with multiple audiences is missing azp")
+	}
+
+	if claims.AuthorizedParty != "" && claims.AuthorizedParty != clientID {
+		return fmt.Errorf("invalid authorized party: expected %s, got %s", clientID, claims.AuthorizedParty)
+	}
+
+	return nil
+}
+
+// containsString reports whether values contains s
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
 
 // IsTokenExpired checks if a token is expired based on the expires_in value
 func IsTokenExpired(tokenResp *TokenResponse, issuedAt time.Time) bool {
+	return isTokenExpiredAt(tokenResp, issuedAt, time.Now())
+}
+
+// IsTokenExpired checks if a token is expired based on the expires_in value,
+// using Config.Clock
+func (tm *TokenManager) IsTokenExpired(tokenResp *TokenResponse, issuedAt time.Time) bool {
+	return isTokenExpiredAt(tokenResp, issuedAt, tm.Client.config.Clock.Now())
+}
+
+// isTokenExpiredAt checks if a token is expired at the given time
+func isTokenExpiredAt(tokenResp *TokenResponse, issuedAt, now time.Time) bool {
 	if tokenResp.ExpiresIn <= 0 {
 		return false // No expiry information
 	}
 
 	expiryTime := issuedAt.Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
-	return time.Now().After(expiryTime)
+	return now.After(expiryTime)
 }
 
 // TokenStorage interface for storing and retrieving tokens
@@ -270,8 +406,10 @@ type TokenStorage interface {
 	Delete(userID string) error
 }
 
-// InMemoryTokenStorage is a simple in-memory token storage implementation
+// InMemoryTokenStorage is a simple in-memory token storage implementation, safe for
+// concurrent use
 type InMemoryTokenStorage struct {
+	mu     sync.RWMutex
 	tokens map[string]*TokenResponse
 }
 
@@ -287,6 +425,9 @@ func (s *InMemoryTokenStorage) Store(userID string, tokens *TokenResponse) error
 	if userID == "" {
 		return errors.New("user ID cannot be empty")
 	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.tokens[userID] = tokens
 	return nil
 }
@@ -297,6 +438,8 @@ func (s *InMemoryTokenStorage) Retrieve(userID string) (*TokenResponse, error) {
 		return nil, errors.New("user ID cannot be empty")
 	}
 
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	tokens, exists := s.tokens[userID]
 	if !exists {
 		return nil, errors.New("tokens not found for user")
@@ -311,6 +454,8 @@ func (s *InMemoryTokenStorage) Delete(userID string) error {
 		return errors.New("user ID cannot be empty")
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	delete(s.tokens, userID)
 	return nil
 }
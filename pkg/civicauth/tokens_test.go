@@ -1,8 +1,20 @@
 package civicauth
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"testing"
 	"time"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
 func TestInMemoryTokenStorage(t *testing.T) {
@@ -98,3 +110,420 @@ func TestIsTokenExpired(t *testing.T) {
 		t.Error("Token without expiry info should not be considered expired")
 	}
 }
+
+func TestValidateIDTokenWithNonce(t *testing.T) {
+	provider := newTestProvider(t)
+	tm := NewTokenManager(provider.newClient(t, nil))
+	ctx := context.Background()
+
+	claims := provider.idTokenClaims()
+	claims["nonce"] = "expected-nonce"
+	idToken := provider.signToken(t, claims)
+
+	validated, err := tm.ValidateIDTokenWithNonce(ctx, idToken, "expected-nonce")
+	if err != nil {
+		t.Fatalf("Expected token to be valid, got: %v", err)
+	}
+	if validated.Nonce != "expected-nonce" {
+		t.Errorf("Expected nonce expected-nonce, got %s", validated.Nonce)
+	}
+
+	if _, err := tm.ValidateIDTokenWithNonce(ctx, idToken, "other-nonce"); err == nil {
+		t.Error("Expected error for mismatched nonce, got nil")
+	}
+
+	if _, err := tm.ValidateIDTokenWithNonce(ctx, idToken, ""); err == nil {
+		t.Error("Expected error for empty expected nonce, got nil")
+	}
+
+	// Tokens without a nonce are rejected when one is expected
+	noNonce := provider.signToken(t, provider.idTokenClaims())
+	if _, err := tm.ValidateIDTokenWithNonce(ctx, noNonce, "expected-nonce"); err == nil {
+		t.Error("Expected error for missing nonce, got nil")
+	}
+
+	// ValidateIDToken does not require a nonce
+	if _, err := tm.ValidateIDToken(ctx, noNonce); err != nil {
+		t.Errorf("Expected token without nonce to be valid, got: %v", err)
+	}
+}
+
+func TestValidateIDTokenAudience(t *testing.T) {
+	provider := newTestProvider(t)
+	tm := NewTokenManager(provider.newClient(t, func(c *Config) {
+		c.TrustedAudiences = []string{"trusted-api"}
+	}))
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		aud         interface{}
+		azp         string
+		expectError bool
+	}{
+		{name: "single string audience", aud: "test-client-id"},
+		{name: "single element array", aud: []string{"test-client-id"}},
+		{name: "trusted extra audience with azp", aud: []string{"test-client-id", "trusted-api"}, azp: "test-client-id"},
+		{name: "multiple audiences without azp", aud: []string{"test-client-id", "trusted-api"}, expectError: true},
+		{name: "untrusted extra audience", aud: []string{"test-client-id", "other-api"}, azp: "test-client-id", expectError: true},
+		{name: "client ID missing", aud: []string{"trusted-api"}, expectError: true},
+		{name: "azp for another client", aud: "test-client-id", azp: "other-client", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := provider.idTokenClaims()
+			claims["aud"] = tt.aud
+			if tt.azp != "" {
+				claims["azp"] = tt.azp
+			}
+
+			_, err := tm.ValidateIDToken(ctx, provider.signToken(t, claims))
+
+			if tt.expectError && err == nil {
+				t.Error("Expected validation error, got nil")
+			}
+
+			if !tt.expectError && err != nil {
+				t.Errorf("Expected no validation error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateIDTokenSigningAlgorithms(t *testing.T) {
+	provider := newTestProvider(t)
+
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+
+	provider.extraKeys = []JWK{
+		ecJWK("p256", "P-256", &p256.PublicKey),
+		ecJWK("p384", "P-384", &p384.PublicKey),
+		{Kty: "OKP", Use: "sig", Kid: "ed", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(edPublic)},
+	}
+	provider.metadata["id_token_signing_alg_values_supported"] = []string{"RS256", "ES256", "ES384", "EdDSA"}
+
+	tm := NewTokenManager(provider.newClient(t, nil))
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		method      jwt.SigningMethod
+		key         interface{}
+		kid         string
+		expectError bool
+	}{
+		{name: "RS256", method: jwt.SigningMethodRS256, key: provider.key, kid: provider.kid},
+		{name: "ES256", method: jwt.SigningMethodES256, key: p256, kid: "p256"},
+		{name: "ES384", method: jwt.SigningMethodES384, key: p384, kid: "p384"},
+		{name: "EdDSA", method: jwt.SigningMethodEdDSA, key: edPrivate, kid: "ed"},
+		{name: "algorithm not advertised", method: jwt.SigningMethodRS512, key: provider.key, kid: provider.kid, expectError: true},
+		{name: "key type does not match algorithm", method: jwt.SigningMethodES256, key: p256, kid: provider.kid, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idToken := signTestToken(t, tt.method, tt.key, tt.kid, provider.idTokenClaims())
+			_, err := tm.ValidateIDToken(ctx, idToken)
+
+			if tt.expectError && err == nil {
+				t.Error("Expected validation error, got nil")
+			}
+
+			if !tt.expectError && err != nil {
+				t.Errorf("Expected no validation error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateIDTokenAlgorithmAllowlist(t *testing.T) {
+	provider := newTestProvider(t)
+
+	restricted := provider.jwks().Keys[0]
+	restricted.Kid = "rs512-only"
+	restricted.Alg = "RS512"
+
+	encryption := provider.jwks().Keys[0]
+	encryption.Kid = "encryption"
+	encryption.Use = "enc"
+
+	provider.extraKeys = []JWK{restricted, encryption}
+
+	tm := NewTokenManager(provider.newClient(t, func(c *Config) {
+		c.AllowedAlgorithms = []string{"RS256", "PS256"}
+	}))
+	ctx := context.Background()
+	claims := provider.idTokenClaims()
+
+	// PS256 is accepted when allowed
+	psToken := signTestToken(t, jwt.SigningMethodPS256, provider.key, provider.kid, claims)
+	if _, err := tm.ValidateIDToken(ctx, psToken); err != nil {
+		t.Errorf("Expected PS256 token to be valid, got: %v", err)
+	}
+
+	// Algorithms outside the allowlist are rejected
+	rs384Token := signTestToken(t, jwt.SigningMethodRS384, provider.key, provider.kid, claims)
+	if _, err := tm.ValidateIDToken(ctx, rs384Token); !errors.Is(err, ErrAlgorithmNotAllowed) {
+		t.Errorf("Expected ErrAlgorithmNotAllowed, got: %v", err)
+	}
+
+	// Unsigned tokens are rejected as insecure
+	noneToken := signTestToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, provider.kid, claims)
+	if _, err := tm.ValidateIDToken(ctx, noneToken); !errors.Is(err, ErrInsecureAlgorithm) {
+		t.Errorf("Expected ErrInsecureAlgorithm for none, got: %v", err)
+	}
+
+	// HMAC tokens using the public key as the secret are rejected as insecure
+	publicKeyBytes := x509.MarshalPKCS1PublicKey(&provider.key.PublicKey)
+	hsToken := signTestToken(t, jwt.SigningMethodHS256, publicKeyBytes, provider.kid, claims)
+	if _, err := tm.ValidateIDToken(ctx, hsToken); !errors.Is(err, ErrInsecureAlgorithm) {
+		t.Errorf("Expected ErrInsecureAlgorithm for HS256, got: %v", err)
+	}
+
+	// The JWK's alg must match the token header
+	mismatched := signTestToken(t, jwt.SigningMethodRS256, provider.key, "rs512-only", claims)
+	if _, err := tm.ValidateIDToken(ctx, mismatched); err == nil {
+		t.Error("Expected error for JWK alg mismatch, got nil")
+	}
+
+	// Keys not intended for signatures are rejected
+	encToken := signTestToken(t, jwt.SigningMethodRS256, provider.key, "encryption", claims)
+	if _, err := tm.ValidateIDToken(ctx, encToken); err == nil {
+		t.Error("Expected error for encryption key, got nil")
+	}
+}
+
+// fixedClock is a Clock that always returns the same time
+type fixedClock struct {
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
+func TestValidateIDTokenTimeClaims(t *testing.T) {
+	provider := newTestProvider(t)
+	now := time.Now().Add(24 * time.Hour)
+	tm := NewTokenManager(provider.newClient(t, func(c *Config) {
+		c.Clock = fixedClock{now: now}
+		c.ClockSkew = time.Minute
+		c.MaxTokenAge = time.Hour
+	}))
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		exp         time.Time
+		iat         time.Time
+		nbf         time.Time
+		expectError bool
+	}{
+		{name: "valid at the injected time", exp: now.Add(time.Hour), iat: now},
+		{name: "expired within leeway", exp: now.Add(-30 * time.Second), iat: now.Add(-time.Minute)},
+		{name: "expired beyond leeway", exp: now.Add(-2 * time.Minute), iat: now.Add(-time.Minute), expectError: true},
+		{name: "issued in the future within leeway", exp: now.Add(time.Hour), iat: now.Add(30 * time.Second)},
+		{name: "issued in the future beyond leeway", exp: now.Add(time.Hour), iat: now.Add(2 * time.Minute), expectError: true},
+		{name: "not yet valid", exp: now.Add(time.Hour), iat: now, nbf: now.Add(5 * time.Minute), expectError: true},
+		{name: "older than max token age", exp: now.Add(time.Hour), iat: now.Add(-2 * time.Hour), expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := provider.idTokenClaims()
+			claims["exp"] = tt.exp.Unix()
+			claims["iat"] = tt.iat.Unix()
+			if !tt.nbf.IsZero() {
+				claims["nbf"] = tt.nbf.Unix()
+			}
+
+			_, err := tm.ValidateIDToken(ctx, provider.signToken(t, claims))
+
+			if tt.expectError && err == nil {
+				t.Error("Expected validation error, got nil")
+			}
+
+			if !tt.expectError && err != nil {
+				t.Errorf("Expected no validation error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateIDTokenWithoutLeeway(t *testing.T) {
+	provider := newTestProvider(t)
+	now := time.Now()
+	tm := NewTokenManager(provider.newClient(t, func(c *Config) {
+		c.Clock = fixedClock{now: now}
+		c.ClockSkew = -1
+	}))
+	ctx := context.Background()
+
+	expired := provider.idTokenClaims()
+	expired["exp"] = now.Add(-time.Second).Unix()
+	expired["iat"] = now.Add(-time.Minute).Unix()
+	if _, err := tm.ValidateIDToken(ctx, provider.signToken(t, expired)); err == nil {
+		t.Error("Expected token expired a second ago to be rejected without leeway")
+	}
+
+	future := provider.idTokenClaims()
+	future["exp"] = now.Add(time.Hour).Unix()
+	future["iat"] = now.Add(30 * time.Second).Unix()
+	if _, err := tm.ValidateIDToken(ctx, provider.signToken(t, future)); err == nil {
+		t.Error("Expected token issued in the future to be rejected without leeway")
+	}
+}
+
+func TestTokenManagerIsTokenExpired(t *testing.T) {
+	provider := newTestProvider(t)
+	issuedAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := &fixedClock{now: issuedAt.Add(30 * time.Minute)}
+	tm := NewTokenManager(provider.newClient(t, func(c *Config) {
+		c.Clock = clock
+	}))
+
+	tokens := &TokenResponse{ExpiresIn: 3600}
+	if tm.IsTokenExpired(tokens, issuedAt) {
+		t.Error("Token should not be expired")
+	}
+
+	clock.now = issuedAt.Add(2 * time.Hour)
+	if !tm.IsTokenExpired(tokens, issuedAt) {
+		t.Error("Token should be expired")
+	}
+}
+
+func TestValidateIDTokenWithOptions(t *testing.T) {
+	provider := newTestProvider(t)
+	now := time.Now()
+	tm := NewTokenManager(provider.newClient(t, func(c *Config) {
+		c.Clock = fixedClock{now: now}
+		c.ClockSkew = time.Minute
+	}))
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		authTime    time.Time
+		acr         string
+		opts        *IDTokenValidationOptions
+		expectError bool
+	}{
+		{name: "recent authentication", authTime: now.Add(-5 * time.Minute), opts: &IDTokenValidationOptions{MaxAge: 600}},
+		{name: "authentication older than max_age", authTime: now.Add(-15 * time.Minute), opts: &IDTokenValidationOptions{MaxAge: 600}, expectError: true},
+		{name: "missing auth_time with max_age", opts: &IDTokenValidationOptions{MaxAge: 600}, expectError: true},
+		{name: "missing auth_time when required", opts: &IDTokenValidationOptions{RequireAuthTime: true}, expectError: true},
+		{name: "acceptable acr", acr: "urn:civic:mfa", opts: &IDTokenValidationOptions{ACRValues: []string{"urn:civic:mfa"}}},
+		{name: "insufficient acr", acr: "urn:civic:password", opts: &IDTokenValidationOptions{ACRValues: []string{"urn:civic:mfa"}}, expectError: true},
+		{name: "missing acr", opts: &IDTokenValidationOptions{ACRValues: []string{"urn:civic:mfa"}}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := provider.idTokenClaims()
+			claims["amr"] = []string{"pwd", "otp"}
+			if !tt.authTime.IsZero() {
+				claims["auth_time"] = tt.authTime.Unix()
+			}
+			if tt.acr != "" {
+				claims["acr"] = tt.acr
+			}
+
+			validated, err := tm.ValidateIDTokenWithOptions(ctx, provider.signToken(t, claims), tt.opts)
+
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected validation error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected no validation error, got: %v", err)
+			}
+			if len(validated.AMR) != 2 || validated.AMR[1] != "otp" {
+				t.Errorf("Expected amr [pwd otp], got %v", validated.AMR)
+			}
+		})
+	}
+}
+
+// leftHalfHash computes an at_hash or c_hash value with SHA-256
+func leftHalfHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+func TestValidateIDTokenHashes(t *testing.T) {
+	provider := newTestProvider(t)
+	tm := NewTokenManager(provider.newClient(t, nil))
+	ctx := context.Background()
+
+	claims := provider.idTokenClaims()
+	claims["at_hash"] = leftHalfHash("access-token")
+	claims["c_hash"] = leftHalfHash("auth-code")
+	idToken := provider.signToken(t, claims)
+
+	tests := []struct {
+		name        string
+		idToken     string
+		opts        *IDTokenValidationOptions
+		expectError bool
+	}{
+		{name: "matching access token", idToken: idToken, opts: &IDTokenValidationOptions{AccessToken: "access-token"}},
+		{name: "substituted access token", idToken: idToken, opts: &IDTokenValidationOptions{AccessToken: "other-token"}, expectError: true},
+		{name: "matching code", idToken: idToken, opts: &IDTokenValidationOptions{AccessToken: "access-token", Code: "auth-code"}},
+		{name: "substituted code", idToken: idToken, opts: &IDTokenValidationOptions{Code: "other-code"}, expectError: true},
+		{name: "at_hash is optional", idToken: provider.signToken(t, provider.idTokenClaims()), opts: &IDTokenValidationOptions{AccessToken: "access-token"}},
+		{name: "c_hash is required for hybrid responses", idToken: provider.signToken(t, provider.idTokenClaims()), opts: &IDTokenValidationOptions{Code: "auth-code"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tm.ValidateIDTokenWithOptions(ctx, tt.idToken, tt.opts)
+
+			if tt.expectError && err == nil {
+				t.Error("Expected validation error, got nil")
+			}
+
+			if !tt.expectError && err != nil {
+				t.Errorf("Expected no validation error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenHashAlgorithms(t *testing.T) {
+	sum384 := sha512.Sum384([]byte("access-token"))
+	sum512 := sha512.Sum512([]byte("access-token"))
+
+	tests := []struct {
+		alg      string
+		expected string
+	}{
+		{alg: "RS256", expected: leftHalfHash("access-token")},
+		{alg: "ES384", expected: base64.RawURLEncoding.EncodeToString(sum384[:24])},
+		{alg: "PS512", expected: base64.RawURLEncoding.EncodeToString(sum512[:32])},
+		{alg: "EdDSA", expected: base64.RawURLEncoding.EncodeToString(sum512[:32])},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.alg, func(t *testing.T) {
+			if err := verifyTokenHash(tt.alg, "access-token", tt.expected); err != nil {
+				t.Errorf("Expected hash to match, got: %v", err)
+			}
+		})
+	}
+}